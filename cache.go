@@ -0,0 +1,267 @@
+/**
+ * GeoTor
+ *
+ *    Copyright 2018 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * cache.go: Query result cache
+ */
+
+package geotor
+
+import (
+	"container/list"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CacheStats reports the effectiveness of the result cache
+type CacheStats struct {
+	Entries int
+	Hits    uint64
+	Misses  uint64
+}
+
+// cacheKey identifies a cached result. Results are cached per network rather than per address, so all the
+// addresses in a network share a single entry.
+type cacheKey struct {
+	prefix netip.Prefix
+	fields Field
+	locale string // Negotiated locale, or empty for every locale
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	result  *GeoLocation
+	expires time.Time
+}
+
+// resultCache is a size and TTL bounded LRU of database results, belonging to a single dataset. Tor data is per
+// address rather than per network, so it isn't cached, and is applied to a copy of the cached result instead.
+type resultCache struct {
+	hits    uint64
+	misses  uint64
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	gen     *dataset // Entries are only valid for the dataset they were looked up in
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+	bits    [2][129]int // Number of entries by address family (IPv4, IPv6) and prefix length, to know which to probe
+}
+
+// newResultCache creates a cache of up to size entries, each kept for at most ttl, or until the next update if ttl
+// is zero. Returns nil, which is a valid cache that never hits, if size is zero.
+func newResultCache(size int, ttl time.Duration) *resultCache {
+	if size <= 0 {
+		return nil
+	}
+	return &resultCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[cacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func family(addr netip.Addr) int {
+	if addr.Is4() {
+		return 0
+	}
+	return 1
+}
+
+// get finds a result for ip cached from dataset d, trying the most specific networks first
+func (c *resultCache) get(d *dataset, ip net.IP, fields Field, locale string) (*GeoLocation, bool) {
+	if c == nil {
+		return nil, false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return nil, false
+	}
+	addr = addr.Unmap()
+	key := cacheKey{fields: fields, locale: locale}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d == c.gen {
+		counts := &c.bits[family(addr)]
+		for bits := addr.BitLen(); bits >= 0; bits -= 1 {
+			if counts[bits] == 0 {
+				continue
+			}
+			key.prefix, _ = addr.Prefix(bits)
+			elem, ok := c.entries[key]
+			if !ok {
+				continue
+			}
+			entry := elem.Value.(*cacheEntry)
+			if c.ttl > 0 && time.Now().After(entry.expires) {
+				c.remove(elem)
+				break
+			}
+			c.lru.MoveToFront(elem)
+			atomic.AddUint64(&c.hits, 1)
+			return entry.result, true
+		}
+	}
+	atomic.AddUint64(&c.misses, 1)
+	return nil, false
+}
+
+// put caches a result from dataset d for every address in network
+func (c *resultCache) put(d *dataset, network netip.Prefix, fields Field, locale string, result *GeoLocation) {
+	if c == nil || !network.IsValid() {
+		return
+	}
+	key := cacheKey{prefix: network, fields: fields, locale: locale}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d != c.gen {
+		// Looked up in a dataset which has since been replaced
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, result: result, expires: time.Now().Add(c.ttl)})
+	c.bits[family(network.Addr())][network.Bits()] += 1
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *resultCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.bits[family(entry.key.prefix.Addr())][entry.key.prefix.Bits()] -= 1
+}
+
+// reset empties the cache, and only accepts results from dataset d from now on
+func (c *resultCache) reset(d *dataset) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen = d
+	c.entries = make(map[cacheKey]*list.Element)
+	c.lru.Init()
+	c.bits = [2][129]int{}
+}
+
+func (c *resultCache) stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	entries := c.lru.Len()
+	c.mu.Unlock()
+	return CacheStats{Entries: entries, Hits: atomic.LoadUint64(&c.hits), Misses: atomic.LoadUint64(&c.misses)}
+}
+
+// clone makes a deep copy of a cached result, which the caller is free to modify
+func (l *GeoLocation) clone() *GeoLocation {
+	ret := *l
+	if l.Position != nil {
+		position := *l.Position
+		ret.Position = &position
+	}
+	if l.ISP != nil {
+		isp := *l.ISP
+		ret.ISP = &isp
+	}
+	if l.Continent != nil {
+		continent := *l.Continent
+		ret.Continent = &continent
+	}
+	if l.Subdivisions != nil {
+		ret.Subdivisions = append(make([]Subdivision, 0, len(l.Subdivisions)), l.Subdivisions...)
+	}
+	ret.RegisteredCountry = l.RegisteredCountry.clone()
+	ret.RepresentedCountry = l.RepresentedCountry.clone()
+	if l.LocationI18n != nil {
+		ret.LocationI18n = make(map[string]string, len(l.LocationI18n))
+		for lang, location := range l.LocationI18n {
+			ret.LocationI18n[lang] = location
+		}
+	}
+	if l.TorNode != nil {
+		nodeid := *l.TorNode
+		ret.TorNode = &nodeid
+	}
+	if l.TorRelays != nil {
+		ret.TorRelays = append(make([]string, 0, len(l.TorRelays)), l.TorRelays...)
+	}
+	if l.Anonymity != nil {
+		anon := *l.Anonymity
+		anon.TorNode = ret.TorNode
+		ret.Anonymity = &anon
+	}
+	if l.Sources != nil {
+		ret.Sources = make(map[string]*SourceResult, len(l.Sources)+1)
+		for section, src := range l.Sources {
+			copied := *src
+			ret.Sources[section] = &copied
+		}
+	}
+	return &ret
+}
+
+func (c *Country) clone() *Country {
+	if c == nil {
+		return nil
+	}
+	ret := *c
+	return &ret
+}
+
+// toPrefix converts a network returned by the database to a prefix, treating IPv4 networks from an IPv6
+// database as plain IPv4
+func toPrefix(network *net.IPNet) netip.Prefix {
+	if network == nil {
+		return netip.Prefix{}
+	}
+	addr, ok := netip.AddrFromSlice(network.IP)
+	if !ok {
+		return netip.Prefix{}
+	}
+	bits, _ := network.Mask.Size()
+	if addr.Is4In6() {
+		addr = addr.Unmap()
+		bits -= 96
+	} else if addr.Is4() && len(network.Mask) == net.IPv6len {
+		bits -= 96
+	}
+	if bits < 0 {
+		return netip.Prefix{}
+	}
+	return netip.PrefixFrom(addr, bits).Masked()
+}
+
+// narrower returns the more specific of two networks containing the same address. Database networks containing an
+// address are always nested, so the narrowest of them is where every database gives the same answer.
+func narrower(a, b netip.Prefix) netip.Prefix {
+	if !a.IsValid() || (b.IsValid() && b.Bits() > a.Bits()) {
+		return b
+	}
+	return a
+}
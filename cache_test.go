@@ -0,0 +1,148 @@
+/**
+ * GeoTor
+ *
+ *    Copyright 2018 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * cache_test.go: Query result cache tests
+ */
+
+package geotor
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestResultCache(t *testing.T) {
+	d := newDataset([kindCount]*dbhandle{}, nil)
+	c := newResultCache(2, 0)
+	c.reset(d)
+
+	wide := &GeoLocation{CountryISO: "US"}
+	narrow := &GeoLocation{CountryISO: "CA"}
+	c.put(d, netip.MustParsePrefix("10.0.0.0/8"), FieldAll, "", wide)
+	c.put(d, netip.MustParsePrefix("10.1.0.0/16"), FieldAll, "", narrow)
+
+	if r, ok := c.get(d, net.ParseIP("10.1.2.3"), FieldAll, ""); !ok || r != narrow {
+		t.Error("expected the most specific network to match")
+	}
+	if r, ok := c.get(d, net.ParseIP("10.2.2.3").To4(), FieldAll, ""); !ok || r != wide {
+		t.Error("expected the wider network to match outside the narrower one")
+	}
+	if _, ok := c.get(d, net.ParseIP("10.1.2.3"), FieldCountry, ""); ok {
+		t.Error("results for different fields must not be shared")
+	}
+	if _, ok := c.get(d, net.ParseIP("11.0.0.1"), FieldAll, ""); ok {
+		t.Error("unexpected hit outside of any cached network")
+	}
+
+	// 10.1.0.0/16 was used least recently, so it goes first
+	c.put(d, netip.MustParsePrefix("2001:db8::/32"), FieldAll, "", wide)
+	if r, ok := c.get(d, net.ParseIP("10.1.2.3"), FieldAll, ""); !ok || r != wide {
+		t.Error("least recently used entry not evicted")
+	}
+	if _, ok := c.get(d, net.ParseIP("2001:db8::1"), FieldAll, ""); !ok {
+		t.Error("expected an IPv6 hit")
+	}
+
+	next := d.withTor(NewTorHash())
+	c.reset(next)
+	if _, ok := c.get(next, net.ParseIP("10.1.2.3"), FieldAll, ""); ok {
+		t.Error("entries survived a new dataset")
+	}
+	c.put(d, netip.MustParsePrefix("10.0.0.0/8"), FieldAll, "", wide)
+	if s := c.stats(); s.Entries != 0 || s.Hits != 4 || s.Misses != 3 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+
+	expiring := newResultCache(10, time.Millisecond)
+	expiring.reset(d)
+	expiring.put(d, netip.MustParsePrefix("10.0.0.0/8"), FieldAll, "", wide)
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := expiring.get(d, net.ParseIP("10.1.2.3"), FieldAll, ""); ok || expiring.stats().Entries != 0 {
+		t.Error("expired entry still served")
+	}
+}
+
+func TestToPrefix(t *testing.T) {
+	_, v4, _ := net.ParseCIDR("81.2.69.0/24")
+	if p := toPrefix(v4); p.String() != "81.2.69.0/24" {
+		t.Errorf("unexpected IPv4 prefix %s", p)
+	}
+	mapped := &net.IPNet{IP: net.ParseIP("::ffff:81.2.69.0"), Mask: net.CIDRMask(120, 128)}
+	if p := toPrefix(mapped); p.String() != "81.2.69.0/24" {
+		t.Errorf("unexpected prefix for a mapped network %s", p)
+	}
+	if toPrefix(nil).IsValid() {
+		t.Error("nil network should not be cacheable")
+	}
+}
+
+func TestCachedResultIsolation(t *testing.T) {
+	nodeid := "ABCD"
+	cached := &GeoLocation{
+		Position:          &Position{Latitude: 1},
+		ISP:               &ISP{ISP: "isp"},
+		Continent:         &Continent{Code: "EU"},
+		Subdivisions:      []Subdivision{{ISOCode: "BY"}},
+		RegisteredCountry: &Country{ISOCode: "DE"},
+		LocationI18n:      map[string]string{"en": "Munich"},
+		TorNode:           &nodeid,
+		TorRelays:         []string{nodeid},
+		Anonymity:         &Anonymity{IsAnonymousVPN: true, TorNode: &nodeid},
+		Sources:           map[string]*SourceResult{SectionLocation: {Edition: EditionGeoIP2City, Found: true}},
+	}
+	r := cached.clone()
+	r.Position.Latitude = 2
+	r.ISP.ISP = "changed"
+	r.Continent.Code = "NA"
+	r.Subdivisions[0].ISOCode = "CA"
+	r.RegisteredCountry.ISOCode = "US"
+	r.LocationI18n["en"] = "changed"
+	*r.TorNode = "changed"
+	r.TorRelays[0] = "changed"
+	r.Anonymity.IsAnonymousVPN = false
+	r.Sources[SectionLocation].Found = false
+	r.Sources[SectionTor] = &SourceResult{Edition: "tor"}
+
+	if cached.Position.Latitude != 1 || cached.ISP.ISP != "isp" || cached.Continent.Code != "EU" ||
+		cached.Subdivisions[0].ISOCode != "BY" || cached.RegisteredCountry.ISOCode != "DE" ||
+		cached.LocationI18n["en"] != "Munich" || *cached.TorNode != "ABCD" || cached.TorRelays[0] != "ABCD" ||
+		!cached.Anonymity.IsAnonymousVPN || *cached.Anonymity.TorNode != "ABCD" ||
+		!cached.Sources[SectionLocation].Found || len(cached.Sources) != 1 {
+		t.Errorf("modifying a copy changed the cached result: %+v", cached)
+	}
+}
+
+func TestTorOnlyQueriesSkipCache(t *testing.T) {
+	g := newTestGeo(t, 1, BackpressureFail)
+	g.cache = newResultCache(10, 0)
+	d := g.snapshot()
+	defer d.release()
+	g.cache.reset(d)
+
+	g.lookup(net.ParseIP("1.2.3.4"), d, newLookupOptions([]LookupOption{WithFields(FieldTor)}))
+	if s := g.CacheStats(); s.Misses != 0 || s.Hits != 0 {
+		t.Errorf("tor only query used the cache: %+v", s)
+	}
+	g.lookup(net.ParseIP("1.2.3.4"), d, newLookupOptions(nil))
+	if s := g.CacheStats(); s.Misses != 1 {
+		t.Errorf("expected a miss for a full query: %+v", s)
+	}
+}
@@ -0,0 +1,319 @@
+/**
+ * GeoTor
+ *
+ *    Copyright 2018 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * city.go: City database record decoding
+ */
+
+package geotor
+
+import (
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"text/template"
+)
+
+// placeRecord is the common shape of the named entities in a city record
+type placeRecord struct {
+	GeoNameID uint              `maxminddb:"geoname_id"`
+	ISOCode   string            `maxminddb:"iso_code"`
+	Names     map[string]string `maxminddb:"names"`
+}
+
+type countryRecord struct {
+	GeoNameID         uint              `maxminddb:"geoname_id"`
+	ISOCode           string            `maxminddb:"iso_code"`
+	IsInEuropeanUnion bool              `maxminddb:"is_in_european_union"`
+	Names             map[string]string `maxminddb:"names"`
+	Type              string            `maxminddb:"type"`
+}
+
+// cityRecord is a full record from the GeoIP2 or GeoLite2 city database
+type cityRecord struct {
+	Position  Position    `maxminddb:"location"`
+	City      placeRecord `maxminddb:"city"`
+	Continent struct {
+		Code      string            `maxminddb:"code"`
+		GeoNameID uint              `maxminddb:"geoname_id"`
+		Names     map[string]string `maxminddb:"names"`
+	} `maxminddb:"continent"`
+	Postal struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"postal"`
+	Subdivisions       []placeRecord `maxminddb:"subdivisions"`
+	Country            countryRecord `maxminddb:"country"`
+	RegisteredCountry  countryRecord `maxminddb:"registered_country"`
+	RepresentedCountry countryRecord `maxminddb:"represented_country"`
+}
+
+func (c *countryRecord) toCountry(locale string) *Country {
+	if c.GeoNameID == 0 && c.ISOCode == "" {
+		return nil
+	}
+	return &Country{
+		GeoNameID:         c.GeoNameID,
+		ISOCode:           c.ISOCode,
+		Name:              localized(c.Names, locale),
+		IsInEuropeanUnion: c.IsInEuropeanUnion,
+		Type:              c.Type,
+	}
+}
+
+// countryCodeRecord, positionRecord and countryPositionRecord are the parts of a city record which are cheap to
+// decode, for queries which don't need names. Each only has the fields it needs, so nothing else is decoded.
+type countryCodes struct {
+	GeoNameID         uint   `maxminddb:"geoname_id"`
+	ISOCode           string `maxminddb:"iso_code"`
+	IsInEuropeanUnion bool   `maxminddb:"is_in_european_union"`
+}
+
+type countryCodeRecord struct {
+	Country countryCodes `maxminddb:"country"`
+}
+
+type positionRecord struct {
+	Position Position `maxminddb:"location"`
+}
+
+type countryPositionRecord struct {
+	Country  countryCodes `maxminddb:"country"`
+	Position Position     `maxminddb:"location"`
+}
+
+// locationParts are the components of a location string, already localized
+type locationParts struct {
+	City         string
+	Subdivisions []string // Smallest first
+	Country      string
+}
+
+// subdivisionPolicy is a SubdivisionPolicy, prepared for use
+type subdivisionPolicy struct {
+	countries map[string]bool // Nil for every country
+	exclude   map[string]bool
+	maxdepth  int
+	formats   map[string]*template.Template
+}
+
+var locationFuncs = template.FuncMap{"join": joinParts}
+
+// newSubdivisionPolicy prepares a policy, falling back to the default policy if p is nil. Templates which don't
+// parse are skipped, leaving their locales with the default layout.
+func newSubdivisionPolicy(p *SubdivisionPolicy, lg *logrus.Entry) *subdivisionPolicy {
+	if p == nil {
+		p = NewDefaultSubdivisionPolicy()
+	}
+	ret := &subdivisionPolicy{
+		exclude:  make(map[string]bool),
+		maxdepth: p.MaxDepth,
+		formats:  make(map[string]*template.Template),
+	}
+	if len(p.Countries) > 0 {
+		ret.countries = make(map[string]bool)
+		for _, iso := range p.Countries {
+			ret.countries[strings.ToUpper(iso)] = true
+		}
+	}
+	for _, iso := range p.Exclude {
+		ret.exclude[strings.ToUpper(iso)] = true
+	}
+	for locale, format := range p.Formats {
+		tmpl, err := template.New(locale).Funcs(locationFuncs).Parse(format)
+		if err != nil {
+			lg.Errorf("Ignoring location format for locale %q: %s", locale, err.Error())
+			continue
+		}
+		ret.formats[locale] = tmpl
+	}
+	return ret
+}
+
+// depth returns the number of subdivisions to include for a country
+func (p *subdivisionPolicy) depth(iso string) int {
+	if p.exclude[iso] || (p.countries != nil && !p.countries[iso]) {
+		return 0
+	}
+	return p.maxdepth
+}
+
+// format lays out a location string in the format for the locale, trying the exact locale, then its base
+// language, then the default
+func (p *subdivisionPolicy) format(locale string, parts *locationParts) string {
+	tmpl, ok := p.formats[locale]
+	if !ok {
+		if i := strings.IndexAny(locale, "-_"); i > 0 {
+			tmpl, ok = p.formats[locale[:i]]
+		}
+	}
+	if !ok {
+		tmpl, ok = p.formats[""]
+	}
+	if !ok {
+		return joinParts(", ", parts.City, parts.Subdivisions, parts.Country)
+	}
+	buf := new(strings.Builder)
+	if err := tmpl.Execute(buf, parts); err != nil {
+		return joinParts(", ", parts.City, parts.Subdivisions, parts.Country)
+	}
+	return buf.String()
+}
+
+// joinParts joins the non-empty strings among parts, which may be strings or string slices, with sep
+func joinParts(sep string, parts ...interface{}) string {
+	flat := make([]string, 0, len(parts)+2)
+	for _, part := range parts {
+		switch v := part.(type) {
+		case string:
+			if v != "" {
+				flat = append(flat, v)
+			}
+		case []string:
+			for _, s := range v {
+				if s != "" {
+					flat = append(flat, s)
+				}
+			}
+		}
+	}
+	return strings.Join(flat, sep)
+}
+
+// localized returns the name in the requested language, falling back to English
+func localized(names map[string]string, lang string) string {
+	if name, ok := names[lang]; ok {
+		return name
+	}
+	return names["en"]
+}
+
+// lookupCity fills in the location parts of ret from the city database. Names are given in locale, or if locale is
+// empty, in English along with every available locale in LocationI18n. Returns the network the record applies to,
+// and whether there is a record at all.
+func lookupCity(ip net.IP, citydb *maxminddb.Reader, policy *subdivisionPolicy, locale string, ret *GeoLocation) (*net.IPNet, bool, error) {
+	var record cityRecord
+	network, found, err := citydb.LookupNetwork(ip, &record)
+	if err != nil || !found {
+		return network, found, err
+	}
+
+	ret.Position = &record.Position
+
+	names := locale
+	if locale == "" {
+		names = defaultLocale
+	}
+	depth := policy.depth(record.Country.ISOCode)
+	if depth > len(record.Subdivisions) {
+		depth = len(record.Subdivisions)
+	}
+	parts := func(lang, countryName string) *locationParts {
+		ret := &locationParts{
+			City:         localized(record.City.Names, lang),
+			Subdivisions: make([]string, depth),
+			Country:      countryName,
+		}
+		for i := 0; i < depth; i += 1 {
+			ret.Subdivisions[depth-1-i] = localized(record.Subdivisions[i].Names, lang)
+		}
+		return ret
+	}
+
+	if locale != "" {
+		ret.Locale = locale
+		ret.City = localized(record.City.Names, locale)
+		if country := localized(record.Country.Names, locale); country != "" {
+			ret.Country = country
+			ret.Location = policy.format(locale, parts(locale, country))
+		}
+	} else {
+		if country, ok := record.Country.Names["en"]; ok {
+			ret.Country = country
+			for lang, countryName := range record.Country.Names {
+				ret.LocationI18n[lang] = policy.format(lang, parts(lang, countryName))
+			}
+		}
+		if city, ok := record.City.Names["en"]; ok {
+			ret.City = city
+		}
+		if location, ok := ret.LocationI18n["en"]; ok {
+			ret.Location = location
+		}
+	}
+	ret.CountryISO = record.Country.ISOCode
+	ret.CityGeoNameID = record.City.GeoNameID
+	ret.CountryGeoNameID = record.Country.GeoNameID
+	ret.IsInEuropeanUnion = record.Country.IsInEuropeanUnion
+	ret.PostalCode = record.Postal.Code
+
+	if record.Continent.Code != "" {
+		ret.Continent = &Continent{
+			Code:      record.Continent.Code,
+			GeoNameID: record.Continent.GeoNameID,
+			Name:      localized(record.Continent.Names, names),
+		}
+	}
+	if len(record.Subdivisions) > 0 {
+		ret.Subdivisions = make([]Subdivision, len(record.Subdivisions))
+		for i, sub := range record.Subdivisions {
+			ret.Subdivisions[i] = Subdivision{GeoNameID: sub.GeoNameID, ISOCode: sub.ISOCode, Name: localized(sub.Names, names)}
+		}
+	}
+	ret.RegisteredCountry = record.RegisteredCountry.toCountry(names)
+	ret.RepresentedCountry = record.RepresentedCountry.toCountry(names)
+	return network, true, nil
+}
+
+// lookupCityFields fills in only FieldCountry and/or FieldPosition from the city database, in a single lookup which
+// decodes nothing else
+func lookupCityFields(ip net.IP, citydb *maxminddb.Reader, fields Field, ret *GeoLocation) (*net.IPNet, bool, error) {
+	var network *net.IPNet
+	var found bool
+	var err error
+	var country *countryCodes
+	var position *Position
+
+	switch fields & (FieldCountry | FieldPosition) {
+	case FieldCountry:
+		record := new(countryCodeRecord)
+		network, found, err = citydb.LookupNetwork(ip, record)
+		country = &record.Country
+	case FieldPosition:
+		record := new(positionRecord)
+		network, found, err = citydb.LookupNetwork(ip, record)
+		position = &record.Position
+	default:
+		record := new(countryPositionRecord)
+		network, found, err = citydb.LookupNetwork(ip, record)
+		country, position = &record.Country, &record.Position
+	}
+	if err != nil || !found {
+		return network, found, err
+	}
+
+	if country != nil {
+		ret.CountryISO = country.ISOCode
+		ret.CountryGeoNameID = country.GeoNameID
+		ret.IsInEuropeanUnion = country.IsInEuropeanUnion
+	}
+	if position != nil {
+		ret.Position = position
+	}
+	return network, true, nil
+}
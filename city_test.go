@@ -0,0 +1,57 @@
+/**
+ * GeoTor
+ *
+ *    Copyright 2018 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * city_test.go: City record formatting tests
+ */
+
+package geotor
+
+import (
+	"github.com/tenta-browser/polychromatic"
+	"testing"
+)
+
+func TestSubdivisionPolicy(t *testing.T) {
+	lg := polychromatic.GetLogger("test")
+
+	def := newSubdivisionPolicy(nil, lg)
+	if def.depth("US") != 1 || def.depth("DE") != 0 {
+		t.Error("default policy doesn't match the historical country list")
+	}
+
+	p := newSubdivisionPolicy(&SubdivisionPolicy{
+		Exclude:  []string{"us"},
+		MaxDepth: 2,
+		Formats: map[string]string{
+			"zh": "{{.Country}}{{join \"\" .Subdivisions}}{{.City}}",
+		},
+	}, lg)
+	if p.depth("US") != 0 || p.depth("GB") != 2 {
+		t.Error("allowlist or denylist not applied")
+	}
+
+	parts := &locationParts{City: "London", Subdivisions: []string{"", "England"}, Country: "United Kingdom"}
+	if s := p.format("en", parts); s != "London, England, United Kingdom" {
+		t.Errorf("unexpected default format %q", s)
+	}
+	parts = &locationParts{City: "上海", Subdivisions: []string{"上海市"}, Country: "中国"}
+	if s := p.format("zh-CN", parts); s != "中国上海市上海" {
+		t.Errorf("unexpected zh format %q", s)
+	}
+}
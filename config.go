@@ -22,32 +22,149 @@
 
 package geotor
 
-import "time"
+import (
+	"net/http"
+	"time"
+)
 
 const versionDataFilename = "geotor.version"
 
+// Supported MaxMind database editions
+const (
+	EditionGeoIP2City   = "GeoIP2-City"
+	EditionGeoIP2ISP    = "GeoIP2-ISP"
+	EditionGeoLite2City = "GeoLite2-City"
+	EditionGeoLite2ASN  = "GeoLite2-ASN"
+
+	EditionGeoIP2AnonymousIP    = "GeoIP2-Anonymous-IP"
+	EditionGeoIP2ConnectionType = "GeoIP2-Connection-Type"
+	EditionGeoIP2Domain         = "GeoIP2-Domain"
+)
+
+const (
+	defaultQueryWorkers   = 32
+	defaultQueryQueueSize = 1024
+)
+
+// BackpressurePolicy decides what happens to a new query when the query queue is full
+type BackpressurePolicy int
+
+const (
+	// BackpressureFail rejects the new query immediately with ErrRequestTimeout
+	BackpressureFail BackpressurePolicy = iota
+	// BackpressureBlock waits for room in the queue until the query's context is done
+	BackpressureBlock
+	// BackpressureDropOldest evicts the longest waiting query, answering it with ErrQueryDropped
+	BackpressureDropOldest
+)
+
+// SubdivisionPolicy controls which subdivisions (states, provinces, etc.) are included in formatted location strings,
+// and how those strings are laid out
+type SubdivisionPolicy struct {
+	Countries []string // ISO codes of the countries which include subdivisions, or empty for all of them
+	Exclude   []string // ISO codes of the countries which never include subdivisions, overriding Countries
+	MaxDepth  int      // Maximum number of subdivisions to include, largest first, or 0 for none at all
+	// Formats holds text/template layouts by locale (e.g. "en", "zh-CN"), with the "" entry used for any other
+	// locale. Templates are executed with the City and Country names, and Subdivisions ordered smallest first, and
+	// may use join to combine the non-empty parts, e.g. {{join ", " .City .Subdivisions .Country}}, the default.
+	Formats map[string]string
+}
+
+// NewDefaultSubdivisionPolicy creates the policy used when none is configured: only the largest subdivision, and
+// only for countries where it's commonly part of an address
+func NewDefaultSubdivisionPolicy() *SubdivisionPolicy {
+	return &SubdivisionPolicy{
+		Countries: []string{"US", "CA", "MX", "IN", "CN"},
+		MaxDepth:  1,
+	}
+}
+
+// TorListFormat is the format of the document at Config.TorUrl
+type TorListFormat int
+
+const (
+	// TorFormatExitAddresses is the TorDNSEL exit list, which only lists exits that have been observed
+	TorFormatExitAddresses TorListFormat = iota
+	// TorFormatOnionoo is an Onionoo details document, listing every relay along with its flags, country and bandwidth
+	TorFormatOnionoo
+)
+
+// OnionooDetailsUrl lists the running relays, to be used with TorFormatOnionoo
+const OnionooDetailsUrl = "https://onionoo.torproject.org/details?type=relay&running=true"
+
 type Config struct {
-	GeoDBPath             string
-	MaxMindUrlTemplate    string
-	MaxMindKey            string
-	TorUrl                string
-	MaxMindUpdateInterval time.Duration
-	TorUpdateInterval     time.Duration
+	GeoDBPath                string
+	MaxMindUrlTemplate       string
+	MaxMindKey               string
+	MaxMindAccountID         string // If set, use the permalink API with basic auth and SHA256 checksums
+	MaxMindPermalinkTemplate string
+	TorUrl                   string
+	TorFormat                TorListFormat // Format of the document at TorUrl
+	MaxMindUpdateInterval    time.Duration
+	TorUpdateInterval        time.Duration
+	QueryWorkers             int                 // Number of goroutines answering queued queries
+	QueryQueueSize           int                 // Number of queries which may wait for a worker
+	QueryBackpressure        BackpressurePolicy  // What to do with a query when the queue is full
+	GeoSource                DatabaseSource      // Where to get databases from, MaxMind using the template and key if nil
+	Editions                 []string            // Database editions to download and serve, at most one of each kind
+	Subdivisions             *SubdivisionPolicy  // Which subdivisions to include in location strings, the default policy if nil
+	LocaleFallbacks          map[string][]string // Locales to try, in order, when one requested with WithLanguages is unavailable, e.g. "zh-HK": {"zh-TW", "zh"}
+	CacheSize                int                 // Number of networks to cache query results for, or 0 to disable the cache
+	CacheTTL                 time.Duration       // How long results stay cached, or 0 to keep them until the databases or tor list change
+	HTTPClient               *http.Client        // Used for all downloads, e.g. to set a proxy or TLS roots. Built from HTTPTimeout if nil
+	HTTPTimeout              time.Duration       // Limit on connecting and waiting for a response, but not on downloading the body
+	HTTPRetries              int                 // Number of times a failed download is retried
+	HTTPRetryDelay           time.Duration       // Backoff before the first retry, doubling on each subsequent one
+	HTTPMaxRetryDelay        time.Duration
 }
 
 // NewDefaultConfig creates a sane config with daily maxmind checks and hourly tor checks
 func NewDefaultConfig() Config {
 	return Config{
-		GeoDBPath:             "/tmp",
-		MaxMindUrlTemplate:    "https://download.maxmind.com/app/geoip_download?edition_id=%s&suffix=%s&license_key=%s",
-		MaxMindKey:            "",
-		TorUrl:                "https://check.torproject.org/exit-addresses",
-		MaxMindUpdateInterval: time.Hour * 24,
-		TorUpdateInterval:     time.Hour,
+		GeoDBPath:                "/tmp",
+		MaxMindUrlTemplate:       "https://download.maxmind.com/app/geoip_download?edition_id=%s&suffix=%s&license_key=%s",
+		MaxMindKey:               "",
+		MaxMindAccountID:         "",
+		MaxMindPermalinkTemplate: MaxMindPermalinkTemplate,
+		TorUrl:                   "https://check.torproject.org/exit-addresses",
+		TorFormat:                TorFormatExitAddresses,
+		Editions:                 []string{EditionGeoIP2City, EditionGeoIP2ISP},
+		MaxMindUpdateInterval:    time.Hour * 24,
+		TorUpdateInterval:        time.Hour,
+		QueryWorkers:             defaultQueryWorkers,
+		QueryQueueSize:           defaultQueryQueueSize,
+		QueryBackpressure:        BackpressureFail,
+		HTTPTimeout:              defaultHTTPTimeout,
+		HTTPRetries:              defaultHTTPRetries,
+		HTTPRetryDelay:           defaultHTTPRetryDelay,
+		HTTPMaxRetryDelay:        defaultHTTPMaxRetryDelay,
 	}
 }
 
 type VersionData struct {
-	City string
-	Isp  string
+	City     string // Deprecated: Version of GeoIP2-City, as written before Editions existed
+	Isp      string // Deprecated: Version of GeoIP2-ISP, as written before Editions existed
+	Editions map[string]string
+}
+
+// version returns the installed version of an edition
+func (v *VersionData) version(edition string) string {
+	if ver, ok := v.Editions[edition]; ok {
+		return ver
+	}
+	switch edition {
+	case EditionGeoIP2City:
+		return v.City
+	case EditionGeoIP2ISP:
+		return v.Isp
+	}
+	return ""
+}
+
+// setVersion records the installed version of an edition
+func (v *VersionData) setVersion(edition, version string) {
+	if v.Editions == nil {
+		v.Editions = make(map[string]string)
+	}
+	v.Editions[edition] = version
 }
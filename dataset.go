@@ -0,0 +1,228 @@
+/**
+ * GeoTor
+ *
+ *    Copyright 2018 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * dataset.go: Immutable, reference counted snapshots of the loaded data
+ */
+
+package geotor
+
+import (
+	"fmt"
+	"github.com/oschwald/maxminddb-golang"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// Addresses which any real database should be able to look up without error
+var validationSamples = []net.IP{
+	net.ParseIP("1.1.1.1"),
+	net.ParseIP("8.8.8.8"),
+	net.ParseIP("81.2.69.142"),
+	net.ParseIP("2001:4860:4860::8888"),
+}
+
+// openDatabase opens a database file and makes sure it is usable as the specified edition before handing it out
+func openDatabase(filename, edition string) (*maxminddb.Reader, error) {
+	r, err := maxminddb.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s database %s: %s", edition, filename, err.Error())
+	}
+	if err = validateDatabase(r, edition); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("invalid %s database %s: %s", edition, filename, err.Error())
+	}
+	return r, nil
+}
+
+// validateDatabase checks the metadata of an open database and performs a few sample lookups
+func validateDatabase(r *maxminddb.Reader, edition string) error {
+	if !strings.HasPrefix(r.Metadata.DatabaseType, edition) {
+		return fmt.Errorf("database type is %q", r.Metadata.DatabaseType)
+	}
+	if r.Metadata.BuildEpoch == 0 || r.Metadata.NodeCount == 0 {
+		return fmt.Errorf("database metadata is incomplete")
+	}
+	for _, ip := range validationSamples {
+		if ip.To4() == nil && r.Metadata.IPVersion != 6 {
+			continue
+		}
+		var record interface{}
+		if err := r.Lookup(ip, &record); err != nil {
+			return fmt.Errorf("sample lookup of %s failed: %s", ip.String(), err.Error())
+		}
+	}
+	return nil
+}
+
+// editionKind is the part an edition plays in answering a query. Editions of the same kind are interchangeable.
+type editionKind int
+
+const (
+	kindCity editionKind = iota
+	kindISP
+	kindAnonymous
+	kindConnectionType
+	kindDomain
+	kindCount
+)
+
+var editionKinds = map[string]editionKind{
+	EditionGeoIP2City:   kindCity,
+	EditionGeoLite2City: kindCity,
+	EditionGeoIP2ISP:    kindISP,
+	EditionGeoLite2ASN:  kindISP,
+
+	EditionGeoIP2AnonymousIP:    kindAnonymous,
+	EditionGeoIP2ConnectionType: kindConnectionType,
+	EditionGeoIP2Domain:         kindDomain,
+}
+
+// dbhandle is a reference counted database reader. The reader is closed, releasing its mmap, when the
+// last dataset using it lets go.
+type dbhandle struct {
+	reader  *maxminddb.Reader
+	edition string
+	version string
+	refs    int32
+}
+
+func newDBHandle(r *maxminddb.Reader, edition, version string) *dbhandle {
+	return &dbhandle{reader: r, edition: edition, version: version, refs: 1}
+}
+
+func (h *dbhandle) retain() *dbhandle {
+	if h != nil {
+		atomic.AddInt32(&h.refs, 1)
+	}
+	return h
+}
+
+func (h *dbhandle) release() {
+	if h == nil {
+		return
+	}
+	if atomic.AddInt32(&h.refs, -1) == 0 && h.reader != nil {
+		h.reader.Close()
+	}
+}
+
+// dataset is everything a lookup needs, frozen at a point in time. A dataset is never modified once
+// published; updates build a new one and swap it in. Geo holds one reference to the current dataset,
+// and every lookup holds another for its duration, so replaced readers stay open until the last
+// in-flight lookup against them is done.
+type dataset struct {
+	dbs  [kindCount]*dbhandle
+	tor  *TorHash
+	refs int32
+}
+
+// newDataset creates a dataset with a single reference, taking ownership of the passed handles
+func newDataset(dbs [kindCount]*dbhandle, tor *TorHash) *dataset {
+	return &dataset{dbs: dbs, tor: tor, refs: 1}
+}
+
+// withTor creates a new dataset sharing this dataset's databases, but with a different tor hash
+func (d *dataset) withTor(tor *TorHash) *dataset {
+	var dbs [kindCount]*dbhandle
+	if d == nil {
+		return newDataset(dbs, tor)
+	}
+	for kind, h := range d.dbs {
+		dbs[kind] = h.retain()
+	}
+	return newDataset(dbs, tor)
+}
+
+// loaded indicates whether the dataset can answer queries, which takes at least one database. Each database is
+// consulted independently, so queries are answered with whatever data is available.
+func (d *dataset) loaded() bool {
+	if d == nil {
+		return false
+	}
+	for _, h := range d.dbs {
+		if h != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// db returns the reader for the specified kind of edition, or nil if there is none
+func (d *dataset) db(kind editionKind) *maxminddb.Reader {
+	if h := d.dbs[kind]; h != nil {
+		return h.reader
+	}
+	return nil
+}
+
+// source describes the database for the specified kind of edition, which must be present
+func (d *dataset) source(kind editionKind) *SourceResult {
+	h := d.dbs[kind]
+	return &SourceResult{Edition: h.edition, Version: h.version, BuildEpoch: h.reader.Metadata.BuildEpoch}
+}
+
+// setNetwork records whether a record was found, and the network it applies to
+func (s *SourceResult) setNetwork(network *net.IPNet, found bool) {
+	s.Found = found
+	if found && network != nil {
+		s.Network = network.String()
+	}
+}
+
+// acquire takes a reference on the dataset, failing if it has already been fully released
+func (d *dataset) acquire() bool {
+	for {
+		n := atomic.LoadInt32(&d.refs)
+		if n <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&d.refs, n, n+1) {
+			return true
+		}
+	}
+}
+
+func (d *dataset) release() {
+	if atomic.AddInt32(&d.refs, -1) == 0 {
+		for _, h := range d.dbs {
+			h.release()
+		}
+	}
+}
+
+// snapshot acquires the current dataset, which must be released by the caller. Returns nil if nothing
+// has been published yet.
+func (g *Geo) snapshot() *dataset {
+	for {
+		d := g.current.Load()
+		if d == nil || d.acquire() {
+			return d
+		}
+		// We raced with a swap which dropped the last reference, so a newer dataset is already published
+	}
+}
+
+// publish makes d the current dataset, releasing Geo's reference on the one it replaces
+func (g *Geo) publish(d *dataset) {
+	if old := g.current.Swap(d); old != nil {
+		old.release()
+	}
+	g.cache.reset(d)
+}
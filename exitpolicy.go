@@ -0,0 +1,236 @@
+/**
+ * GeoTor
+ *
+ *    Copyright 2018 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * exitpolicy.go: Tor exit policy evaluation
+ */
+
+package geotor
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	Low  int
+	High int
+}
+
+// PolicySummary is a relay's exit policy reduced to ports, as published by the directory authorities. It lists
+// either the ports which are accepted or the ports which are rejected for most destinations.
+type PolicySummary struct {
+	Accept bool
+	Ports  []PortRange
+}
+
+// ExitPolicyRule is a single line of an exit policy, e.g. "reject 10.0.0.0/8:*" or "accept *:443"
+type ExitPolicyRule struct {
+	Accept  bool
+	Network netip.Prefix // Invalid for *, which matches any address
+	Ports   PortRange
+}
+
+// ExitPolicy describes where a relay is willing to exit to. Rules is the relay's full IPv4 policy, evaluated in
+// order with the first match deciding; SummaryV4 is used when the rules aren't known, and SummaryV6 for IPv6
+// destinations. A relay without a SummaryV6 doesn't exit over IPv6.
+type ExitPolicy struct {
+	Rules     []ExitPolicyRule
+	SummaryV4 *PolicySummary
+	SummaryV6 *PolicySummary
+}
+
+// Allows indicates whether the policy lets connections out to dest:port
+func (p *ExitPolicy) Allows(dest net.IP, port int) bool {
+	addr, ok := canonicalAddr(dest)
+	if !ok {
+		return false
+	}
+	if addr.Is6() {
+		return p.SummaryV6.allows(port)
+	}
+	if len(p.Rules) > 0 {
+		for _, rule := range p.Rules {
+			if rule.matches(addr, port) {
+				return rule.Accept
+			}
+		}
+		// Tor accepts anything a policy doesn't mention, though published policies always end with a catch all
+		return true
+	}
+	return p.SummaryV4.allows(port)
+}
+
+func (r *ExitPolicyRule) matches(addr netip.Addr, port int) bool {
+	if r.Network.IsValid() && !r.Network.Contains(addr) {
+		return false
+	}
+	return port >= r.Ports.Low && port <= r.Ports.High
+}
+
+func (s *PolicySummary) allows(port int) bool {
+	if s == nil {
+		return false
+	}
+	for _, r := range s.Ports {
+		if port >= r.Low && port <= r.High {
+			return s.Accept
+		}
+	}
+	return !s.Accept
+}
+
+// acceptsAny indicates whether the summary allows exiting to at least one port
+func (s *PolicySummary) acceptsAny() bool {
+	if s == nil {
+		return false
+	}
+	if s.Accept {
+		return len(s.Ports) > 0
+	}
+	// Rejected ranges may overlap and come in any order, so look for the first port none of them covers
+	for port := 1; port <= 65535; {
+		covered := false
+		for _, r := range s.Ports {
+			if port >= r.Low && port <= r.High {
+				port = r.High + 1
+				covered = true
+			}
+		}
+		if !covered {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePortRange parses "443", "6660-6669" or "*"
+func parsePortRange(s string) (PortRange, error) {
+	if s == "*" {
+		return PortRange{Low: 1, High: 65535}, nil
+	}
+	lowstr, highstr := s, s
+	if i := strings.Index(s, "-"); i > 0 {
+		lowstr, highstr = s[:i], s[i+1:]
+	}
+	low, err := strconv.Atoi(lowstr)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port %q", s)
+	}
+	high, err := strconv.Atoi(highstr)
+	if err != nil || high < low {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return PortRange{Low: low, High: high}, nil
+}
+
+// parseExitPolicyRule parses a rule as it appears in a server descriptor, e.g. "reject 0.0.0.0/8:*"
+func parseExitPolicyRule(line string) (ExitPolicyRule, error) {
+	var ret ExitPolicyRule
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return ret, fmt.Errorf("malformed exit policy rule %q", line)
+	}
+	switch fields[0] {
+	case "accept":
+		ret.Accept = true
+	case "reject":
+	default:
+		return ret, fmt.Errorf("unknown exit policy action in %q", line)
+	}
+	i := strings.LastIndex(fields[1], ":")
+	if i < 0 {
+		return ret, fmt.Errorf("exit policy rule %q has no port", line)
+	}
+	host, ports := fields[1][:i], fields[1][i+1:]
+	var err error
+	if ret.Ports, err = parsePortRange(ports); err != nil {
+		return ret, err
+	}
+	if host == "*" {
+		return ret, nil
+	}
+	host = strings.Replace(strings.Replace(host, "[", "", 1), "]", "", 1)
+	if strings.Contains(host, "/") {
+		ret.Network, err = netip.ParsePrefix(host)
+	} else {
+		var addr netip.Addr
+		if addr, err = netip.ParseAddr(host); err == nil {
+			ret.Network = netip.PrefixFrom(addr, addr.BitLen())
+		}
+	}
+	if err != nil {
+		return ret, fmt.Errorf("invalid address in exit policy rule %q", line)
+	}
+	ret.Network = ret.Network.Masked()
+	return ret, nil
+}
+
+// newPolicySummary builds a summary from its Onionoo representation, where exactly one of accept and reject is set
+func newPolicySummary(accept, reject []string) (*PolicySummary, error) {
+	if accept == nil && reject == nil {
+		return nil, nil
+	}
+	ret := &PolicySummary{Accept: accept != nil, Ports: make([]PortRange, 0)}
+	ports := reject
+	if ret.Accept {
+		ports = accept
+	}
+	for _, p := range ports {
+		r, err := parsePortRange(p)
+		if err != nil {
+			return nil, err
+		}
+		ret.Ports = append(ret.Ports, r)
+	}
+	return ret, nil
+}
+
+// CanExitTo indicates whether the node could have carried a connection to dest:port. A known exit policy decides on
+// its own, as relays exiting to only a few ports lack the Exit flag. Nodes without one, such as those from the exit
+// list, are assumed to exit anywhere, as long as they're exits at all.
+//
+// This can disagree with IsExit and lookups for an address traffic has been observed exiting from: those report what
+// the relay has done, so the address stays a tor exit, while the policy says what it allows now, which may be nothing.
+func (t *TorNode) CanExitTo(dest net.IP, port int) bool {
+	if t.ExitPolicy != nil {
+		return t.ExitPolicy.Allows(dest, port)
+	}
+	return t.IsExit()
+}
+
+// CanExitTo indicates whether any tor relay exiting from ip could have carried a connection to dest:port, like a
+// TorDNSEL query. Relays only using ip as an OR address aren't considered, and neither is an ip of a different
+// address family than dest, which the connection couldn't have come from.
+func (t *TorHash) CanExitTo(ip, dest net.IP, port int) bool {
+	addr, ok := canonicalAddr(ip)
+	destaddr, destok := canonicalAddr(dest)
+	if !ok || !destok || addr.Is4() != destaddr.Is4() {
+		return false
+	}
+	for _, node := range t.hash[addr] {
+		if node.exitsFrom(addr) && node.CanExitTo(dest, port) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+/**
+ * GeoTor
+ *
+ *    Copyright 2018 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * fetch.go: HTTP fetching shared by the updaters
+ */
+
+package geotor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHTTPTimeout       = time.Minute * 5
+	defaultHTTPRetries       = 3
+	defaultHTTPRetryDelay    = time.Second * 2
+	defaultHTTPMaxRetryDelay = time.Minute
+)
+
+var errFetchStopped = errors.New("fetch abandoned due to shutdown")
+
+// cachedResponse is what we remember of a response to answer conditional requests
+type cachedResponse struct {
+	etag         string
+	lastmodified string
+	body         []byte
+}
+
+// fetcher performs HTTP requests on behalf of the updaters. Failed requests are retried with exponential backoff
+// and jitter, and fetchCached makes conditional requests, so unchanged content only costs a 304.
+type fetcher struct {
+	client   *http.Client
+	retries  int
+	delay    time.Duration
+	maxdelay time.Duration
+	ctx      context.Context // Cancelled on shutdown, aborting requests and downloads in flight
+	mu       sync.Mutex
+	cache    map[string]*cachedResponse
+}
+
+// newFetcher creates a fetcher according to the config, which gives up retrying once done is closed
+func newFetcher(cfg Config, done <-chan struct{}) *fetcher {
+	f := &fetcher{
+		client:   cfg.HTTPClient,
+		retries:  cfg.HTTPRetries,
+		delay:    cfg.HTTPRetryDelay,
+		maxdelay: cfg.HTTPMaxRetryDelay,
+		ctx:      context.Background(),
+		cache:    make(map[string]*cachedResponse),
+	}
+	if done != nil {
+		var cancel context.CancelFunc
+		f.ctx, cancel = context.WithCancel(f.ctx)
+		go func() {
+			<-done
+			cancel()
+		}()
+	}
+	if f.client == nil {
+		f.client = &http.Client{Transport: newTransport(cfg.HTTPTimeout)}
+	}
+	if f.retries < 0 {
+		f.retries = 0
+	}
+	if f.delay <= 0 {
+		f.delay = defaultHTTPRetryDelay
+	}
+	if f.maxdelay < f.delay {
+		f.maxdelay = f.delay
+	}
+	return f
+}
+
+// newTransport creates a transport which gives up on an unresponsive server after timeout, applied separately to
+// connecting, the TLS handshake and waiting for the response headers. Reading the body isn't limited, as downloading a
+// database can take a long time on a slow link; the fetcher's context aborts it on shutdown instead.
+func newTransport(timeout time.Duration) *http.Transport {
+	if timeout <= 0 {
+		timeout = defaultHTTPTimeout
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+	t.TLSHandshakeTimeout = timeout
+	t.ResponseHeaderTimeout = timeout
+	return t
+}
+
+// defaultFetcher is used by sources which haven't been handed one by an updater
+func defaultFetcher() *fetcher {
+	return newFetcher(Config{HTTPRetries: defaultHTTPRetries}, nil)
+}
+
+// retryable indicates whether a response status is worth trying again
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// backoff returns how long to wait before the specified retry: exponential growth, capped, with jitter
+func (f *fetcher) backoff(attempt int) time.Duration {
+	d := f.delay << uint(attempt)
+	if d <= 0 || d > f.maxdelay {
+		d = f.maxdelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// fetch performs req, retrying on network errors and server side failures. Any other response, successful or not,
+// is returned to the caller, who must close its body. Reading the body fails once the fetcher is stopped.
+func (f *fetcher) fetch(req *http.Request) (*http.Response, error) {
+	req = req.WithContext(f.ctx)
+	for attempt := 0; ; attempt += 1 {
+		resp, err := f.client.Do(req)
+		if f.ctx.Err() != nil {
+			if err == nil {
+				resp.Body.Close()
+			}
+			return nil, errFetchStopped
+		}
+		if err == nil && !retryable(resp.StatusCode) {
+			return resp, nil
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("unexpected status fetching %s: %s", req.URL.Redacted(), resp.Status)
+		}
+		if attempt >= f.retries {
+			return nil, err
+		}
+		select {
+		case <-time.After(f.backoff(attempt)):
+		case <-f.ctx.Done():
+			return nil, errFetchStopped
+		}
+	}
+}
+
+// fetchCached performs req as a conditional request, based on the validators from the last successful response to
+// the same URL. Returns the body, which is the remembered one if the server says it's unchanged, and whether it
+// was modified.
+func (f *fetcher) fetchCached(req *http.Request) ([]byte, bool, error) {
+	key := req.URL.String()
+	f.mu.Lock()
+	cached := f.cache[key]
+	f.mu.Unlock()
+
+	if cached != nil {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastmodified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastmodified)
+		}
+	}
+
+	resp, err := f.fetch(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		return cached.body, false, nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return body, true, &statusError{status: resp.StatusCode, msg: resp.Status}
+	}
+
+	etag, lastmodified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	f.mu.Lock()
+	if etag != "" || lastmodified != "" {
+		f.cache[key] = &cachedResponse{etag: etag, lastmodified: lastmodified, body: body}
+	} else {
+		delete(f.cache, key)
+	}
+	f.mu.Unlock()
+	return body, true, nil
+}
+
+// statusError reports an unsuccessful response, for callers which want to inspect the body anyway
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status %s", e.msg)
+}
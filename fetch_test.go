@@ -0,0 +1,119 @@
+/**
+ * GeoTor
+ *
+ *    Copyright 2018 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * fetch_test.go: HTTP fetching tests
+ */
+
+package geotor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFetchRetriesAndConditional(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests += 1
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	f := newFetcher(Config{HTTPRetries: 2, HTTPRetryDelay: time.Millisecond}, nil)
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	body, modified, err := f.fetchCached(req)
+	if err != nil {
+		t.Fatalf("fetch failed despite retries: %s", err.Error())
+	}
+	if !modified || string(body) != "content" || requests != 2 {
+		t.Errorf("unexpected first fetch: modified %v, body %q after %d requests", modified, body, requests)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, server.URL, nil)
+	body, modified, err = f.fetchCached(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if modified || string(body) != "content" {
+		t.Errorf("unexpected conditional fetch: modified %v, body %q", modified, body)
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	slowheaders := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	}))
+	defer slowheaders.Close()
+	slowbody := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i += 1 {
+			w.Write([]byte("chunk"))
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer slowbody.Close()
+
+	f := newFetcher(Config{HTTPTimeout: 50 * time.Millisecond}, nil)
+	req, _ := http.NewRequest(http.MethodGet, slowheaders.URL, nil)
+	if _, _, err := f.fetchCached(req); err == nil {
+		t.Error("expected a timeout waiting for the response headers")
+	}
+	// The body takes far longer than the timeout, but keeps coming
+	req, _ = http.NewRequest(http.MethodGet, slowbody.URL, nil)
+	if body, _, err := f.fetchCached(req); err != nil || string(body) != "chunkchunkchunk" {
+		t.Errorf("slow download cut off: %q, %v", body, err)
+	}
+}
+
+func TestFetchStopsOnShutdown(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	done := make(chan struct{})
+	f := newFetcher(Config{HTTPRetries: 2, HTTPRetryDelay: time.Millisecond}, done)
+	time.AfterFunc(50*time.Millisecond, func() { close(done) })
+
+	start := time.Now()
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	if _, err := f.fetch(req); err != errFetchStopped {
+		t.Errorf("expected errFetchStopped, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("shutdown took %s to abort a request in flight", elapsed)
+	}
+}
@@ -28,12 +28,13 @@ import (
 	"encoding/gob"
 	"errors"
 	"fmt"
-	"github.com/oschwald/maxminddb-golang"
 	"github.com/sirupsen/logrus"
 	"github.com/tenta-browser/polychromatic"
 	"io/ioutil"
 	"net"
+	"net/netip"
 	"path/filepath"
+	"sync/atomic"
 )
 
 type responsewrapper struct {
@@ -45,38 +46,101 @@ type Query struct {
 	dummy bool
 	ip    net.IP
 	resp  chan *responsewrapper
-	valid bool
+	opts  *lookupOptions
+	valid atomic.Bool
 }
 
-var ErrRequestTimeout = errors.New("unable to queue the geo request for processing")
+// QueueStats is a point in time view of the query queue
+type QueueStats struct {
+	Depth    int    // Queries currently waiting for a worker
+	Capacity int    // Maximum number of waiting queries
+	Workers  int    // Number of query workers
+	Rejected uint64 // Queries refused because the queue was full
+	Dropped  uint64 // Queued queries evicted to make room for newer ones
+}
+
+type reloadResult struct {
+	err  error
+	errs map[string]error // By edition
+}
+
+// Status describes the state of every source of data, keyed by edition name, with the tor list under "tor"
+type Status struct {
+	Sources map[string]SourceStatus `json:"sources"`
+}
+
+// SourceStatus describes the state of one source of data
+type SourceStatus struct {
+	Loaded  bool   `json:"loaded"`
+	Version string `json:"version,omitempty"`
+	Entries int    `json:"entries,omitempty"` // Only for the tor list
+	Error   string `json:"error,omitempty"`   // From the most recent reload
+}
+
+// BatchResult holds the outcome for a single address of a QueryBatch call
+type BatchResult struct {
+	Location *GeoLocation
+	Err      error
+}
+
+var (
+	ErrRequestTimeout = errors.New("unable to queue the geo request for processing")
+	ErrNotLoaded      = errors.New("geo databases are not loaded")
+	ErrQueryDropped   = errors.New("the geo request was dropped to make room for newer requests")
+	ErrNotFound       = errors.New("the address was not found in any of the geo sources")
+	ErrInvalidIP      = errors.New("not a valid IPv4 or IPv6 address")
+	ErrDatabase       = errors.New("geo database lookup failed") // Wrapped with the details, check with errors.Is
+)
 
 type Geo struct {
-	loaded   bool
-	reload   chan bool
-	queries  chan *Query
-	citydb   *maxminddb.Reader
-	ispdb    *maxminddb.Reader
-	tordb    *TorHash
-	newtordb chan *TorHash
-	lg       *logrus.Entry
-	rt       *runtime
+	rejected     uint64 // Accessed atomically, kept first for 64-bit alignment
+	dropped      uint64
+	current      atomic.Pointer[dataset]
+	reloaderr    atomic.Pointer[reloadResult]
+	reload       chan bool
+	queries      chan *Query
+	editions     []string
+	subdivisions *subdivisionPolicy
+	fallbacks    map[string][]string
+	cache        *resultCache
+	policy       BackpressurePolicy
+	workers      int
+	newtordb     chan *TorHash
+	lg           *logrus.Entry
+	rt           *runtime
 }
 
 func StartGeo(cfg Config) *Geo {
 	g := new(Geo)
 
-	rt := newRuntime()
+	if cfg.QueryWorkers <= 0 {
+		cfg.QueryWorkers = defaultQueryWorkers
+	}
+	if cfg.QueryQueueSize <= 0 {
+		cfg.QueryQueueSize = defaultQueryQueueSize
+	}
+
+	rt := newRuntime(cfg.QueryWorkers)
 
 	g.lg = polychromatic.GetLogger("geo")
 	g.rt = rt
-	g.loaded = false
 	g.reload = make(chan bool, 2) // Startup reload + after the updater runs, we might have one pending
-	g.queries = make(chan *Query, 1024)
+	g.queries = make(chan *Query, cfg.QueryQueueSize)
+	g.policy = cfg.QueryBackpressure
+	g.workers = cfg.QueryWorkers
 	g.newtordb = make(chan *TorHash, 1)
+	g.editions = resolveEditions(cfg.Editions, g.lg)
+	g.subdivisions = newSubdivisionPolicy(cfg.Subdivisions, g.lg)
+	g.fallbacks = newLocaleFallbacks(cfg.LocaleFallbacks)
+	g.cache = newResultCache(cfg.CacheSize, cfg.CacheTTL)
 
+	rt.wg.Add(rt.services) // Before starting anything, so that an early Shutdown can't miss a service
 	go torupdater(cfg, rt, g)
 	go geoupdater(cfg, rt, g)
 	go geolisten(cfg, rt, g)
+	for i := 0; i < cfg.QueryWorkers; i += 1 {
+		go queryworker(rt, g)
+	}
 
 	return g
 }
@@ -84,223 +148,533 @@ func StartGeo(cfg Config) *Geo {
 func (g *Geo) Shutdown() {
 	defer g.rt.wg.Wait()
 
-	for i := 0; i < runtimeStartedServices; i += 1 {
+	close(g.rt.done)
+	for i := 0; i < g.rt.services; i += 1 {
 		g.rt.stop <- true
 	}
 }
 
+// Loaded indicates whether queries can be answered, which takes at least one database. See Status for the state of
+// each individual source.
 func (g *Geo) Loaded() bool {
-	return g.loaded
+	return g.current.Load().loaded()
+}
+
+// Status reports the state of each configured edition and the tor list
+func (g *Geo) Status() Status {
+	ret := Status{Sources: make(map[string]SourceStatus, len(g.editions)+1)}
+	d := g.snapshot()
+	if d != nil {
+		defer d.release()
+	}
+	r := g.reloaderr.Load()
+
+	for _, edition := range g.editions {
+		st := SourceStatus{}
+		if d != nil {
+			if h := d.dbs[editionKinds[edition]]; h != nil && h.edition == edition {
+				st.Loaded = true
+				st.Version = h.version
+			}
+		}
+		if r != nil {
+			if err, ok := r.errs[edition]; ok {
+				st.Error = err.Error()
+			} else if r.err != nil && len(r.errs) == 0 {
+				// The reload failed before getting to individual editions
+				st.Error = r.err.Error()
+			}
+		}
+		ret.Sources[edition] = st
+	}
+
+	tor := SourceStatus{}
+	if d != nil && d.tor != nil {
+		tor.Loaded = true
+		tor.Entries = d.tor.Len()
+	}
+	ret.Sources["tor"] = tor
+	return ret
+}
+
+// Lookup synchronously resolves ip against the currently loaded databases. Unlike Query, it
+// does not go through the listener and may be called from any number of goroutines at once.
+func (g *Geo) Lookup(ctx context.Context, ip net.IP, opts ...LookupOption) (*GeoLocation, error) {
+	return g.lookupContext(ctx, ip, newLookupOptions(opts))
+}
+
+func (g *Geo) lookupContext(ctx context.Context, ip net.IP, o *lookupOptions) (*GeoLocation, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if !validIP(ip) {
+		return nil, ErrInvalidIP
+	}
+	d := g.snapshot()
+	if d == nil {
+		return nil, ErrNotLoaded
+	}
+	defer d.release()
+	if !d.loaded() {
+		return nil, ErrNotLoaded
+	}
+	return g.lookup(ip, d, o)
+}
+
+// validIP checks that ip is something the databases can look up, which a nil or truncated net.IP isn't
+func validIP(ip net.IP) bool {
+	return len(ip) == net.IPv4len || len(ip) == net.IPv6len
 }
 
-func (g *Geo) Query(ip net.IP) (*Query, error) {
+func newQuery(ip net.IP, o *lookupOptions) *Query {
 	q := new(Query)
 	q.ip = ip
+	q.opts = o
 	q.resp = make(chan *responsewrapper, 1) // Make sure we can stuff one in and drop it if we're already running when it gets canceled
-	q.valid = true
+	q.valid.Store(true)
+	return q
+}
+
+// Query queues an async query for ip. It is equivalent to QueryContext with a background context, so under
+// BackpressureBlock it will wait for room in the queue for as long as it takes.
+func (g *Geo) Query(ip net.IP, opts ...LookupOption) (*Query, error) {
+	return g.QueryContext(context.Background(), ip, opts...)
+}
+
+// QueryContext queues an async query for ip, applying the configured backpressure policy if the queue is full.
+// The context only governs queueing; pass a context to Response to bound the wait for the answer.
+func (g *Geo) QueryContext(ctx context.Context, ip net.IP, opts ...LookupOption) (*Query, error) {
+	if !validIP(ip) {
+		return nil, ErrInvalidIP
+	}
+	q := newQuery(ip, newLookupOptions(opts))
 
 	select {
 	case g.queries <- q:
 		return q, nil
 	default:
+	}
+
+	switch g.policy {
+	case BackpressureBlock:
+		select {
+		case g.queries <- q:
+			return q, nil
+		case <-ctx.Done():
+			atomic.AddUint64(&g.rejected, 1)
+			return nil, ctx.Err()
+		}
+	case BackpressureDropOldest:
+		for {
+			select {
+			case g.queries <- q:
+				return q, nil
+			default:
+			}
+			select {
+			case old := <-g.queries:
+				// Nobody else writes to an unprocessed query's response channel, so this can't block
+				old.resp <- &responsewrapper{err: ErrQueryDropped}
+				atomic.AddUint64(&g.dropped, 1)
+			default:
+			}
+		}
+	default:
+		atomic.AddUint64(&g.rejected, 1)
 		return nil, ErrRequestTimeout
 	}
 }
 
+// QueueDepth returns the number of queries currently waiting for a worker
+func (g *Geo) QueueDepth() int {
+	return len(g.queries)
+}
+
+// QueueStats returns the current state of the query queue
+func (g *Geo) QueueStats() QueueStats {
+	return QueueStats{
+		Depth:    len(g.queries),
+		Capacity: cap(g.queries),
+		Workers:  g.workers,
+		Rejected: atomic.LoadUint64(&g.rejected),
+		Dropped:  atomic.LoadUint64(&g.dropped),
+	}
+}
+
+// CacheStats returns the hit and miss counts of the result cache, which are zero if it's disabled
+func (g *Geo) CacheStats() CacheStats {
+	return g.cache.stats()
+}
+
+// QueryBatch resolves every address in ips using the query worker pool, and returns the results in the same
+// order as the input. Regardless of the backpressure policy, it waits for room in the queue until ctx is done.
+// Addresses which could not be resolved carry their own error in the corresponding BatchResult.
+func (g *Geo) QueryBatch(ctx context.Context, ips []net.IP, opts ...LookupOption) []BatchResult {
+	ret := make([]BatchResult, len(ips))
+	pending := make([]*Query, len(ips))
+	o := newLookupOptions(opts)
+
+	for i, ip := range ips {
+		if ctx.Err() != nil {
+			ret[i].Err = ctx.Err()
+			continue
+		}
+		if !validIP(ip) {
+			ret[i].Err = ErrInvalidIP
+			continue
+		}
+		q := newQuery(ip, o)
+		select {
+		case g.queries <- q:
+			pending[i] = q
+		case <-ctx.Done():
+			ret[i].Err = ctx.Err()
+		}
+	}
+
+	for i, q := range pending {
+		if q != nil {
+			ret[i].Location, ret[i].Err = q.Response(ctx)
+		}
+	}
+
+	return ret
+}
+
 func (q *Query) Response(ctx context.Context) (*GeoLocation, error) {
 	if ctx.Err() != nil {
-		q.valid = false
+		q.valid.Store(false)
 		return nil, ctx.Err()
 	}
 	select {
 	case wrap := <-q.resp:
 		return wrap.response, wrap.err
 	case <-ctx.Done():
-		q.valid = false
+		q.valid.Store(false)
 		return nil, ctx.Err()
 	}
 }
 
 func geolisten(cfg Config, rt *runtime, g *Geo) {
 	defer rt.wg.Done()
-	rt.wg.Add(1)
 	g.lg.Debug("Started listener")
 	defer func() {
 		g.lg.Debug("Shut down")
 	}()
 	for {
-		if g.loaded {
-			select {
-			case q := <-g.queries:
-				if q.valid {
-					go doQuery(q, g.citydb, g.ispdb, g.tordb, g.lg)
-				} else {
-					g.lg.Debug("Query is no longer valid")
-				}
-			case <-g.reload:
-				g.lg.Debug("Got a command to reload in loaded state")
-				doReload(cfg, g)
-			case th := <-g.newtordb:
-				g.lg.Debug("Got a new tordb in unloaded state")
-				g.tordb = th
-			case <-rt.stop:
-				g.lg.Debug("Got shutdown command in loaded state")
-				return
-			}
-		} else {
-			select {
-			case <-g.reload:
-				g.lg.Debug("Got a command to reload in unloaded state")
-				doReload(cfg, g)
-			case th := <-g.newtordb:
-				g.lg.Debug("Got a new tordb in unloaded state")
-				g.tordb = th
-			case <-rt.stop:
-				g.lg.Debug("Got shutdown command in unloaded state")
-				return
+		select {
+		case <-g.reload:
+			g.lg.Debug("Got a command to reload")
+			doReload(cfg, g)
+		case th := <-g.newtordb:
+			g.lg.Debug("Got a new tordb")
+			g.setTorHash(th)
+		case <-rt.stop:
+			g.lg.Debug("Got shutdown command")
+			return
+		}
+	}
+}
+
+// queryworker answers queued queries. A fixed number of these are started, which bounds the number of
+// lookups in flight regardless of how many queries are queued. Queries answered before any database has loaded
+// fail with ErrNotLoaded, like Lookup, rather than waiting for a load which may never succeed.
+func queryworker(rt *runtime, g *Geo) {
+	defer rt.wg.Done()
+
+	for {
+		select {
+		case q := <-g.queries:
+			if q.valid.Load() {
+				doQuery(q, g)
+			} else {
+				g.lg.Debug("Query is no longer valid")
 			}
+		case <-rt.stop:
+			return
 		}
 	}
 }
 
+// setTorHash publishes a dataset using the new tor hash alongside the current databases. Only the listener
+// publishes datasets, so there is no race between loading the current one and replacing it.
+func (g *Geo) setTorHash(th *TorHash) {
+	g.publish(g.current.Load().withTor(th))
+}
+
+// doReload builds a new dataset from the versions recorded on disk and publishes it. Each edition is reloaded
+// independently: if one fails to open or validate, its previous version (if any) keeps serving alongside whatever
+// did reload, and the failure is recorded for Status and LastReloadError.
 func doReload(cfg Config, g *Geo) {
-	g.loaded = false
 	g.lg.Info("Doing a reload")
-	success := 0
 
-	var cityver, ispver string
+	var dbs [kindCount]*dbhandle
+	current := g.current.Load()
+	result := &reloadResult{errs: make(map[string]error)}
+	defer g.reloaderr.Store(result)
+
 	versionfile := filepath.Join(cfg.GeoDBPath, versionDataFilename)
 	verbytes, err := ioutil.ReadFile(versionfile)
 	verinfo := &VersionData{}
 	if err == nil {
 		err = gob.NewDecoder(bytes.NewReader(verbytes)).Decode(verinfo)
-		if err == nil {
-			cityver = verinfo.City
-			ispver = verinfo.Isp
+	}
+	if err != nil {
+		result.err = fmt.Errorf("unable to read version file %s: %s", versionfile, err.Error())
+		g.lg.Errorf("Reload failure: %s", result.err.Error())
+		return
+	}
+
+	for _, edition := range g.editions {
+		kind := editionKinds[edition]
+		h, err := reloadDatabase(cfg, g, current, edition, verinfo.version(edition))
+		if err != nil {
+			result.errs[edition] = err
+			if current != nil && current.dbs[kind] != nil {
+				g.lg.Errorf("Reload failure, continuing with the previous %s: %s", edition, err.Error())
+				dbs[kind] = current.dbs[kind].retain()
+			} else {
+				g.lg.Errorf("Reload failure, %s is unavailable: %s", edition, err.Error())
+			}
+			continue
 		}
+		dbs[kind] = h
+	}
+	if len(result.errs) > 0 {
+		result.err = fmt.Errorf("failed to reload %d of %d editions", len(result.errs), len(g.editions))
 	}
 
-	if cityver != "" {
-		cityfile := filepath.Join(cfg.GeoDBPath, fmt.Sprintf("%s-%s.mmdb", "GeoIP2-City", cityver))
-		g.lg.Debugf("Geo: Opening city file %s", cityfile)
-		r, err := maxminddb.Open(cityfile)
-		if err == nil {
-			g.citydb = r
-			success += 1
-		} else {
-			g.lg.Errorf("Failed to open city database %s: %s", cityfile, err.Error())
+	if current != nil {
+		g.publish(newDataset(dbs, current.tor))
+	} else {
+		g.publish(newDataset(dbs, nil))
+	}
+	if result.err == nil {
+		g.lg.Info("Reloaded Successfully")
+	}
+}
+
+// reloadDatabase returns a handle for the specified version of a database, reusing the current one if the
+// version hasn't changed
+func reloadDatabase(cfg Config, g *Geo, current *dataset, edition, version string) (*dbhandle, error) {
+	if version == "" {
+		return nil, fmt.Errorf("no version of %s is installed", edition)
+	}
+	if current != nil {
+		if h := current.dbs[editionKinds[edition]]; h != nil && h.edition == edition && h.version == version {
+			return h.retain(), nil
 		}
 	}
+	dbfile := filepath.Join(cfg.GeoDBPath, fmt.Sprintf("%s-%s.mmdb", edition, version))
+	g.lg.Debugf("Opening %s file %s", edition, dbfile)
+	r, err := openDatabase(dbfile, edition)
+	if err != nil {
+		return nil, err
+	}
+	return newDBHandle(r, edition, version), nil
+}
 
-	if ispver != "" {
-		ispfile := filepath.Join(cfg.GeoDBPath, fmt.Sprintf("%s-%s.mmdb", "GeoIP2-ISP", ispver))
-		g.lg.Debugf("Opening isp file %s", ispfile)
-		r, err := maxminddb.Open(ispfile)
-		if err == nil {
-			g.ispdb = r
-			success += 1
-		} else {
-			g.lg.Errorf("Failed to open isp database %s: %s", ispfile, err.Error())
+// resolveEditions returns the usable editions from the configured list, dropping unknown ones and duplicates of
+// a kind. Falls back to the GeoIP2 City and ISP editions if none are configured.
+func resolveEditions(editions []string, lg *logrus.Entry) []string {
+	if len(editions) == 0 {
+		return []string{EditionGeoIP2City, EditionGeoIP2ISP}
+	}
+	ret := make([]string, 0, len(editions))
+	seen := make(map[editionKind]string)
+	for _, edition := range editions {
+		kind, ok := editionKinds[edition]
+		if !ok {
+			lg.Errorf("Ignoring unsupported edition %s", edition)
+			continue
+		}
+		if other, ok := seen[kind]; ok {
+			lg.Errorf("Ignoring edition %s, %s already provides the same data", edition, other)
+			continue
 		}
+		seen[kind] = edition
+		ret = append(ret, edition)
 	}
+	return ret
+}
 
-	if success == 2 {
-		g.loaded = true
-		g.lg.Info("Reloaded Successfully")
-	} else {
-		g.lg.Error("Reload failure")
+// LastReloadError returns the error from the most recent database reload, or nil if it succeeded or none
+// has happened yet
+func (g *Geo) LastReloadError() error {
+	if r := g.reloaderr.Load(); r != nil {
+		return r.err
 	}
+	return nil
 }
 
-func shouldIncludeSubdivision(iso string) bool {
-	if iso == "US" || iso == "CA" || iso == "MX" || iso == "IN" || iso == "CN" {
-		return true
+func doQuery(q *Query, g *Geo) {
+	ret, err := g.lookupContext(context.Background(), q.ip, q.opts)
+	wrap := &responsewrapper{
+		response: ret,
+		err:      err,
 	}
-	return false
+	q.resp <- wrap
 }
 
-func doQuery(q *Query, citydb, ispdb *maxminddb.Reader, tordb *TorHash, lg *logrus.Entry) {
-	ret := &GeoLocation{
-		ISP:          &ISP{},
-		LocationI18n: make(map[string]string, 0),
-	}
-
-	ispErr := ispdb.Lookup(q.ip, &ret.ISP)
-	if ispErr != nil {
-		lg.Warnf("ISP error: %s", ispErr.Error())
-		ret.ISP = nil
-	}
-	var record struct {
-		Position Position `maxminddb:"location"`
-		City     struct {
-			Names map[string]string `maxminddb:"names"`
-		} `maxminddb:"city"`
-		Subdivisions []struct {
-			Names map[string]string `maxminddb:"names"`
-		} `maxminddb:"subdivisions"`
-		Country struct {
-			Names   map[string]string `maxminddb:"names"`
-			ISOCode string            `maxminddb:"iso_code"`
-		} `maxminddb:"country"`
-	}
-	lookupError := citydb.Lookup(q.ip, &record)
-	if lookupError != nil {
-		lg.Warnf("Lookup error: %s", lookupError.Error())
-		ret = nil
-	} else {
+// lookup is the query engine shared by the sync and async APIs
+func (g *Geo) lookup(ip net.IP, d *dataset, o *lookupOptions) (*GeoLocation, error) {
+	locale := ""
+	if citydb := d.db(kindCity); citydb != nil && o.negotiate && o.fields&FieldLocation != 0 {
+		locale = resolveLocale(o.languages, g.fallbacks, citydb.Metadata.Languages)
+	}
 
-		ret.Position = &record.Position
-
-		if country, ok := record.Country.Names["en"]; ok {
-			ret.Country = country
-			for lang, countryName := range record.Country.Names {
-				var subdivision = ""
-				if shouldIncludeSubdivision(record.Country.ISOCode) && len(record.Subdivisions) > 0 {
-					subdivision, ok = record.Subdivisions[0].Names[lang]
-					if !ok {
-						subdivision, ok = record.Subdivisions[0].Names["en"]
-						if !ok {
-							subdivision = ""
-						}
-					}
-				}
-				var cityName = ""
-				cityName, ok = record.City.Names[lang]
-				if !ok {
-					cityName, ok = record.City.Names["en"]
-					if !ok {
-						cityName = ""
-					}
-				}
-				if subdivision != "" {
-					countryName = fmt.Sprintf("%s, %s", subdivision, countryName)
-				}
-				if cityName != "" {
-					countryName = fmt.Sprintf("%s, %s", cityName, countryName)
-				}
-				ret.LocationI18n[lang] = countryName
+	// Tor data is per address, so queries which only want that have nothing to cache
+	cache := g.cache
+	if o.fields&^FieldTor == 0 {
+		cache = nil
+	}
+
+	ret, cached := cache.get(d, ip, o.fields, locale)
+	if !cached {
+		var prefix netip.Prefix
+		var err error
+		if ret, prefix, err = g.lookupDatabases(ip, d, o, locale); err != nil {
+			return nil, err
+		}
+		cache.put(d, prefix, o.fields, locale, ret)
+	}
+	if cache != nil {
+		// The cached copy is shared, so every caller gets its own
+		ret = ret.clone()
+	}
+
+	if d.tor != nil && o.fields&FieldTor != 0 {
+		ret.Sources[SectionTor] = &SourceResult{Edition: "tor"}
+		ret.TorNode = nil
+		ret.TorRelays = nil
+		addr, _ := canonicalAddr(ip)
+		for _, node := range d.tor.LookupAll(ip) {
+			ret.Sources[SectionTor].Found = true
+			ret.TorRelays = append(ret.TorRelays, node.NodeId)
+			// An exit's OR addresses don't necessarily carry exit traffic
+			if ret.TorNode == nil && node.exitsFrom(addr) {
+				nodeid := node.NodeId
+				ret.TorNode = &nodeid
 			}
 		}
-		if city, ok := record.City.Names["en"]; ok {
-			ret.City = city
+		if ret.Anonymity == nil {
+			ret.Anonymity = &Anonymity{}
+		}
+		ret.Anonymity.TorNode = ret.TorNode
+		if ret.TorNode != nil {
+			// The exit list is authoritative, whether or not the anonymous IP database has caught up
+			ret.Anonymity.IsAnonymous = true
+			ret.Anonymity.IsTorExitNode = true
+		}
+	}
+
+	if len(ret.Sources) == 0 {
+		// None of the sources needed for the requested fields are loaded, so we can't say whether it would be found
+		return nil, ErrNotLoaded
+	}
+	for _, src := range ret.Sources {
+		if src.Found {
+			return ret, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// lookupDatabases answers the database sections of a query, in locale if it's set. Returns the network which the
+// answer applies to, which is where all of the consulted databases give the same answer.
+func (g *Geo) lookupDatabases(ip net.IP, d *dataset, o *lookupOptions, locale string) (*GeoLocation, netip.Prefix, error) {
+	var prefix netip.Prefix
+	ret := &GeoLocation{
+		Sources: make(map[string]*SourceResult, kindCount+1),
+	}
+	if o.fields&FieldLocation != 0 && !o.negotiate {
+		// Without a preference, keep answering in every locale, as before WithLanguages existed
+		ret.LocationI18n = make(map[string]string, 0)
+	}
+
+	if ispdb := d.db(kindISP); ispdb != nil && o.fields&FieldNetwork != 0 {
+		src := d.source(kindISP)
+		ret.Sources[SectionNetwork] = src
+		ret.ISP = &ISP{}
+		network, found, ispErr := ispdb.LookupNetwork(ip, &ret.ISP)
+		if ispErr != nil {
+			return nil, prefix, g.databaseError(src, ispErr)
 		}
-		if location, ok := ret.LocationI18n["en"]; ok {
-			ret.Location = location
+		src.setNetwork(network, found)
+		prefix = narrower(prefix, toPrefix(network))
+		if !found {
+			ret.ISP = nil
 		}
-		ret.CountryISO = record.Country.ISOCode
 	}
 
-	if tordb != nil {
-		if nodeid, present := tordb.Exists(q.ip); present {
-			ret.TorNode = &nodeid
+	if citydb := d.db(kindCity); citydb != nil && o.fields&(FieldLocation|FieldCountry|FieldPosition) != 0 {
+		src := d.source(kindCity)
+		ret.Sources[SectionLocation] = src
+		var network *net.IPNet
+		var found bool
+		var lookupError error
+		if o.fields&FieldLocation != 0 {
+			network, found, lookupError = lookupCity(ip, citydb, g.subdivisions, locale, ret)
 		} else {
-			ret.TorNode = nil
+			network, found, lookupError = lookupCityFields(ip, citydb, o.fields, ret)
+		}
+		if lookupError != nil {
+			return nil, prefix, g.databaseError(src, lookupError)
 		}
+		src.setNetwork(network, found)
+		prefix = narrower(prefix, toPrefix(network))
 	}
 
-	wrap := &responsewrapper{
-		response: ret,
-		err:      lookupError,
+	if anondb := d.db(kindAnonymous); anondb != nil && o.fields&FieldAnonymity != 0 {
+		src := d.source(kindAnonymous)
+		ret.Sources[SectionAnonymity] = src
+		ret.Anonymity = &Anonymity{}
+		network, found, anonErr := anondb.LookupNetwork(ip, ret.Anonymity)
+		if anonErr != nil {
+			return nil, prefix, g.databaseError(src, anonErr)
+		}
+		src.setNetwork(network, found)
+		prefix = narrower(prefix, toPrefix(network))
+		if !found {
+			ret.Anonymity = nil
+		}
 	}
-	q.resp <- wrap
+
+	if ctdb := d.db(kindConnectionType); ctdb != nil && o.fields&FieldConnectionType != 0 {
+		src := d.source(kindConnectionType)
+		ret.Sources[SectionConnectionType] = src
+		var record struct {
+			ConnectionType string `maxminddb:"connection_type"`
+		}
+		network, found, ctErr := ctdb.LookupNetwork(ip, &record)
+		if ctErr != nil {
+			return nil, prefix, g.databaseError(src, ctErr)
+		}
+		src.setNetwork(network, found)
+		prefix = narrower(prefix, toPrefix(network))
+		ret.ConnectionType = record.ConnectionType
+	}
+
+	if domaindb := d.db(kindDomain); domaindb != nil && o.fields&FieldDomain != 0 {
+		src := d.source(kindDomain)
+		ret.Sources[SectionDomain] = src
+		var record struct {
+			Domain string `maxminddb:"domain"`
+		}
+		network, found, domainErr := domaindb.LookupNetwork(ip, &record)
+		if domainErr != nil {
+			return nil, prefix, g.databaseError(src, domainErr)
+		}
+		src.setNetwork(network, found)
+		prefix = narrower(prefix, toPrefix(network))
+		ret.Domain = record.Domain
+	}
+
+	return ret, prefix, nil
+}
+
+// databaseError logs and wraps a failed lookup, so that callers can tell it apart from a missing record
+func (g *Geo) databaseError(src *SourceResult, err error) error {
+	g.lg.Warnf("%s lookup error: %s", src.Edition, err.Error())
+	return fmt.Errorf("%w: %s lookup failed: %s", ErrDatabase, src.Edition, err.Error())
 }
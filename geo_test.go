@@ -23,11 +23,21 @@
 package geotor
 
 import (
+	"bytes"
 	"context"
+	"encoding/gob"
+	"errors"
+	"github.com/oschwald/maxminddb-golang"
 	"github.com/sirupsen/logrus"
 	"github.com/tenta-browser/polychromatic"
+	"io/ioutil"
 	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -43,23 +53,459 @@ func TestStartGeo(t *testing.T) {
 		time.Sleep(100 * time.Millisecond)
 	}
 
+	wg := &sync.WaitGroup{}
 	for i := 0; i < 100; i += 1 {
+		wg.Add(1)
 		go func() {
+			defer wg.Done()
 			b := make([]byte, 4)
 			rand.Read(b)
 			ip := net.IPv4(b[0], b[1], b[2], b[3])
 			q, err := g.Query(ip)
 			if err != nil {
-				t.Fail()
+				t.Errorf("unable to query %s: %s", ip.String(), err.Error())
+				return
 			}
 			r, err := q.Response(context.TODO())
+			if err == ErrNotFound {
+				// Random addresses are often unallocated or reserved
+				return
+			}
 			if err != nil {
-				t.Fail()
+				t.Errorf("query for %s failed: %s", ip.String(), err.Error())
+				return
 			}
 			tor := r.TorNode != nil
 			polychromatic.GetLogger("test").Infof("%s -> %s / %v", ip.String(), r.Location, tor)
 		}()
 	}
+	wg.Wait()
 
 	g.Shutdown()
 }
+
+func TestDatasetSwap(t *testing.T) {
+	g := new(Geo)
+	published := make([]*dataset, 0)
+
+	wg := &sync.WaitGroup{}
+	stop := make(chan struct{})
+	for i := 0; i < 8; i += 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if d := g.snapshot(); d != nil {
+					if atomic.LoadInt32(&d.refs) < 2 {
+						t.Error("acquired a dataset without holding a reference")
+					}
+					d.tor.Len()
+					d.release()
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 1000; i += 1 {
+		d := g.current.Load().withTor(NewTorHash())
+		published = append(published, d)
+		g.publish(d)
+	}
+	close(stop)
+	wg.Wait()
+
+	for i, d := range published {
+		refs := atomic.LoadInt32(&d.refs)
+		if i == len(published)-1 && refs != 1 {
+			t.Errorf("current dataset has %d references, expected 1", refs)
+		} else if i < len(published)-1 && refs != 0 {
+			t.Errorf("replaced dataset %d has %d references, expected 0", i, refs)
+		}
+	}
+}
+
+func TestReloadKeepsPrevious(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geotor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := Config{GeoDBPath: dir}
+
+	// The new city database is corrupt, while the ISP database is fine
+	verinfo := &VersionData{}
+	verinfo.setVersion(EditionGeoIP2City, "2")
+	verinfo.setVersion(EditionGeoIP2ISP, "2")
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(verinfo); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		versionDataFilename:  buf.Bytes(),
+		"GeoIP2-City-2.mmdb": []byte("not really a database"),
+		"GeoIP2-ISP-2.mmdb":  testDatabase(EditionGeoIP2ISP),
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	g := &Geo{lg: polychromatic.GetLogger("test"), editions: []string{EditionGeoIP2City, EditionGeoIP2ISP}}
+	var dbs [kindCount]*dbhandle
+	previous := testDBHandle(t, EditionGeoIP2City, "1")
+	dbs[kindCity] = previous
+	g.publish(newDataset(dbs, testTorHash()))
+	old := g.snapshot()
+	defer old.release()
+
+	doReload(cfg, g)
+
+	d := g.snapshot()
+	defer d.release()
+	if d == old || d.dbs[kindCity] != previous || d.tor != old.tor {
+		t.Error("previous city database or tor hash not carried over")
+	}
+	if refs := atomic.LoadInt32(&previous.refs); refs != 2 {
+		t.Errorf("expected the previous city database to be shared by both datasets, got %d references", refs)
+	}
+	if h := d.dbs[kindISP]; h == nil || h.version != "2" {
+		t.Error("ISP database not loaded alongside the failed city database")
+	}
+	if err := g.LastReloadError(); err == nil {
+		t.Error("failed reload not reported")
+	}
+	status := g.Status()
+	if city := status.Sources[EditionGeoIP2City]; !city.Loaded || city.Version != "1" || city.Error == "" {
+		t.Errorf("unexpected city status %+v", city)
+	}
+	if isp := status.Sources[EditionGeoIP2ISP]; !isp.Loaded || isp.Version != "2" || isp.Error != "" {
+		t.Errorf("unexpected ISP status %+v", isp)
+	}
+}
+
+func TestResolveEditions(t *testing.T) {
+	lg := polychromatic.GetLogger("test")
+	cases := []struct {
+		editions []string
+		want     []string
+	}{
+		{nil, []string{EditionGeoIP2City, EditionGeoIP2ISP}},
+		{[]string{EditionGeoLite2City, EditionGeoLite2ASN}, []string{EditionGeoLite2City, EditionGeoLite2ASN}},
+		{[]string{EditionGeoIP2City, "GeoIP2-Unknown", EditionGeoIP2ISP}, []string{EditionGeoIP2City, EditionGeoIP2ISP}},
+		{[]string{EditionGeoIP2City, EditionGeoLite2City, EditionGeoIP2AnonymousIP}, []string{EditionGeoIP2City, EditionGeoIP2AnonymousIP}},
+		{[]string{EditionGeoLite2ASN, EditionGeoIP2ISP, EditionGeoIP2Domain}, []string{EditionGeoLite2ASN, EditionGeoIP2Domain}},
+		{[]string{"GeoIP2-Unknown"}, []string{}},
+	}
+	for _, c := range cases {
+		if got := resolveEditions(c.editions, lg); strings.Join(got, ",") != strings.Join(c.want, ",") {
+			t.Errorf("%v: got %v, expected %v", c.editions, got, c.want)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	g := &Geo{lg: polychromatic.GetLogger("test"), editions: []string{EditionGeoIP2City, EditionGeoIP2ISP, EditionGeoIP2AnonymousIP}}
+	if s := g.Status(); len(s.Sources) != 4 || s.Sources[EditionGeoIP2City].Loaded || s.Sources["tor"].Loaded {
+		t.Errorf("unexpected status before anything is published %+v", s)
+	}
+
+	// Only the city database and tor list are loaded, and the ISP database failed to reload
+	var dbs [kindCount]*dbhandle
+	dbs[kindCity] = testDBHandle(t, EditionGeoIP2City, "5")
+	g.publish(newDataset(dbs, testTorHash()))
+	g.reloaderr.Store(&reloadResult{err: errors.New("failed"), errs: map[string]error{EditionGeoIP2ISP: errors.New("corrupt")}})
+
+	s := g.Status()
+	if city := s.Sources[EditionGeoIP2City]; !city.Loaded || city.Version != "5" || city.Error != "" {
+		t.Errorf("unexpected city status %+v", city)
+	}
+	if isp := s.Sources[EditionGeoIP2ISP]; isp.Loaded || isp.Error != "corrupt" {
+		t.Errorf("unexpected ISP status %+v", isp)
+	}
+	if anon := s.Sources[EditionGeoIP2AnonymousIP]; anon.Loaded || anon.Error != "" {
+		t.Errorf("unexpected anonymous IP status %+v", anon)
+	}
+	if tor := s.Sources["tor"]; !tor.Loaded || tor.Entries != 1 {
+		t.Errorf("unexpected tor status %+v", tor)
+	}
+
+	// A database of the same kind but another edition doesn't count, and a reload which failed outright applies to all
+	g.editions = []string{EditionGeoLite2City}
+	g.reloaderr.Store(&reloadResult{err: errors.New("no version file"), errs: map[string]error{}})
+	if lite := g.Status().Sources[EditionGeoLite2City]; lite.Loaded || lite.Error != "no version file" {
+		t.Errorf("unexpected status for an edition which isn't loaded %+v", lite)
+	}
+}
+
+// benchGeo serves the city database named by GEOTOR_CITY_DB, skipping the benchmark if there is none
+func benchGeo(b *testing.B) (*Geo, *dataset) {
+	filename := os.Getenv("GEOTOR_CITY_DB")
+	if filename == "" {
+		b.Skip("set GEOTOR_CITY_DB to a GeoIP2 or GeoLite2 city database to run lookup benchmarks")
+	}
+	r, err := maxminddb.Open(filename)
+	if err != nil {
+		b.Fatalf("unable to open %s: %s", filename, err.Error())
+	}
+	lg := polychromatic.GetLogger("bench")
+	g := &Geo{lg: lg, subdivisions: newSubdivisionPolicy(nil, lg)}
+	var dbs [kindCount]*dbhandle
+	dbs[kindCity] = newDBHandle(r, r.Metadata.DatabaseType, "bench")
+	return g, newDataset(dbs, nil)
+}
+
+func benchmarkLookup(b *testing.B, opts ...LookupOption) {
+	g, d := benchGeo(b)
+	defer d.release()
+	o := newLookupOptions(opts)
+	ips := make([]net.IP, 1024)
+	for i := range ips {
+		ips[i] = net.IPv4(byte(rand.Intn(223)+1), byte(rand.Intn(256)), byte(rand.Intn(256)), byte(rand.Intn(256)))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i += 1 {
+		if _, err := g.lookup(ips[i%len(ips)], d, o); err != nil && err != ErrNotFound {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLookupAll(b *testing.B) {
+	benchmarkLookup(b)
+}
+
+func BenchmarkLookupNegotiated(b *testing.B) {
+	benchmarkLookup(b, WithLanguages("de, en;q=0.5"))
+}
+
+func BenchmarkLookupCountry(b *testing.B) {
+	benchmarkLookup(b, WithFields(FieldCountry))
+}
+
+func BenchmarkLookupPosition(b *testing.B) {
+	benchmarkLookup(b, WithFields(FieldPosition))
+}
+
+func BenchmarkLookupCountryPosition(b *testing.B) {
+	benchmarkLookup(b, WithFields(FieldCountry|FieldPosition))
+}
+
+func TestLookupErrors(t *testing.T) {
+	g := &Geo{lg: polychromatic.GetLogger("test")}
+	if _, err := g.Lookup(context.Background(), net.IP{1, 2, 3}); err != ErrInvalidIP {
+		t.Errorf("expected ErrInvalidIP for a truncated address, got %v", err)
+	}
+	if _, err := g.Lookup(context.Background(), net.ParseIP("1.2.3.4")); err != ErrNotLoaded {
+		t.Errorf("expected ErrNotLoaded before anything is published, got %v", err)
+	}
+
+	d := newDataset([kindCount]*dbhandle{}, testTorHash())
+	defer d.release()
+	o := newLookupOptions(nil)
+
+	if _, err := g.lookup(net.ParseIP("5.6.7.8"), d, o); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for an unknown address, got %v", err)
+	}
+	if _, err := g.lookup(net.ParseIP("1.2.3.4"), d, newLookupOptions([]LookupOption{WithFields(FieldCountry)})); err != ErrNotLoaded {
+		t.Errorf("expected ErrNotLoaded when no source for the requested fields is loaded, got %v", err)
+	}
+	r, err := g.lookup(net.ParseIP("1.2.3.4"), d, o)
+	if err != nil {
+		t.Fatalf("unexpected error for a tor exit: %s", err.Error())
+	}
+	if !r.Sources[SectionTor].Found || r.TorNode == nil || *r.TorNode != "ABCD" {
+		t.Error("tor exit not reported as found")
+	}
+}
+
+// testTorHash creates a tor hash with a single exit, ABCD at 1.2.3.4
+func testTorHash() *TorHash {
+	th := NewTorHash()
+	node := NewTorNode()
+	node.NodeId = "ABCD"
+	node.Addresses = append(node.Addresses, ExitAddress{IP: net.ParseIP("1.2.3.4")})
+	th.Add(node)
+	return th
+}
+
+// testDatabase builds a minimal IPv4 MaxMind DB of the specified type, in which no address has a record. The search
+// tree is a single node whose records both point past the tree, which is how the format marks a miss.
+func testDatabase(dbtype string) []byte {
+	buf := &bytes.Buffer{}
+	buf.Write([]byte{0, 0, 1, 0, 0, 1}) // One node, two 24 bit records
+	buf.Write(make([]byte, 16))         // Data section separator, followed by an empty data section
+	buf.WriteString("\xab\xcd\xefMaxMind.com")
+
+	str := func(s string) {
+		buf.WriteByte(2<<5 | byte(len(s)))
+		buf.WriteString(s)
+	}
+	num := func(typ byte, v uint64) {
+		b := make([]byte, 0, 8)
+		for ; v > 0; v >>= 8 {
+			b = append([]byte{byte(v)}, b...)
+		}
+		if typ < 8 {
+			buf.WriteByte(typ<<5 | byte(len(b)))
+		} else {
+			buf.Write([]byte{byte(len(b)), typ - 7}) // Extended type
+		}
+		buf.Write(b)
+	}
+	buf.WriteByte(7<<5 | 9) // Map of 9 entries
+	str("binary_format_major_version")
+	num(5, 2)
+	str("binary_format_minor_version")
+	num(5, 0)
+	str("build_epoch")
+	num(9, 1514764800)
+	str("database_type")
+	str(dbtype)
+	str("description")
+	buf.WriteByte(7 << 5) // Empty map
+	str("ip_version")
+	num(5, 4)
+	str("languages")
+	buf.Write([]byte{0, 11 - 7}) // Empty array, an extended type
+	str("node_count")
+	num(6, 1)
+	str("record_size")
+	num(5, 24)
+	return buf.Bytes()
+}
+
+// testDBHandle opens a testDatabase for the specified edition
+func testDBHandle(t *testing.T, edition, version string) *dbhandle {
+	r, err := maxminddb.FromBytes(testDatabase(edition))
+	if err != nil {
+		t.Fatalf("unable to open test database: %s", err.Error())
+	}
+	return newDBHandle(r, edition, version)
+}
+
+// newTestGeo creates a Geo with a small query queue and no workers, serving an empty ISP database and testTorHash
+func newTestGeo(t *testing.T, queue int, policy BackpressurePolicy) *Geo {
+	g := &Geo{
+		lg:      polychromatic.GetLogger("test"),
+		queries: make(chan *Query, queue),
+		policy:  policy,
+		workers: 1,
+	}
+	var dbs [kindCount]*dbhandle
+	dbs[kindISP] = testDBHandle(t, EditionGeoIP2ISP, "test")
+	g.publish(newDataset(dbs, testTorHash()))
+	return g
+}
+
+func TestQueryBackpressure(t *testing.T) {
+	ip := net.ParseIP("1.2.3.4")
+
+	g := newTestGeo(t, 2, BackpressureFail)
+	for i := 0; i < 2; i += 1 {
+		if _, err := g.Query(ip); err != nil {
+			t.Fatalf("query %d rejected with room in the queue: %s", i, err.Error())
+		}
+	}
+	if _, err := g.Query(ip); err != ErrRequestTimeout {
+		t.Errorf("expected ErrRequestTimeout from a full queue, got %v", err)
+	}
+
+	g.policy = BackpressureBlock
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := g.QueryContext(ctx, ip); err != context.DeadlineExceeded {
+		t.Errorf("expected the context's error while blocked, got %v", err)
+	}
+	if s := g.QueueStats(); s.Rejected != 2 || s.Dropped != 0 || s.Depth != 2 || s.Capacity != 2 || s.Workers != 1 {
+		t.Errorf("unexpected stats after rejections %+v", s)
+	}
+
+	g = newTestGeo(t, 2, BackpressureDropOldest)
+	oldest, _ := g.Query(ip)
+	g.Query(ip)
+	newest, err := g.Query(ip)
+	if err != nil || newest == nil {
+		t.Fatalf("newest query not queued: %v", err)
+	}
+	if _, err := oldest.Response(context.Background()); err != ErrQueryDropped {
+		t.Errorf("expected ErrQueryDropped for the evicted query, got %v", err)
+	}
+	if s := g.QueueStats(); s.Rejected != 0 || s.Dropped != 1 || s.Depth != 2 {
+		t.Errorf("unexpected stats after dropping %+v", s)
+	}
+}
+
+func TestQueryBatch(t *testing.T) {
+	g := newTestGeo(t, 8, BackpressureFail)
+	rt := newRuntime(1)
+	rt.wg.Add(1)
+	go queryworker(rt, g)
+	defer func() {
+		rt.stop <- true
+		rt.wg.Wait()
+	}()
+
+	ips := []net.IP{net.ParseIP("5.6.7.8"), net.IP{1, 2}, net.ParseIP("1.2.3.4"), nil, net.ParseIP("::ffff:1.2.3.4")}
+	results := g.QueryBatch(context.Background(), ips)
+	if len(results) != len(ips) {
+		t.Fatalf("expected %d results, got %d", len(ips), len(results))
+	}
+	expected := []error{ErrNotFound, ErrInvalidIP, nil, ErrInvalidIP, nil}
+	for i, r := range results {
+		if r.Err != expected[i] {
+			t.Errorf("result %d: expected error %v, got %v", i, expected[i], r.Err)
+		}
+		if (r.Err == nil) != (r.Location != nil) || (r.Location != nil && r.Location.TorNode == nil) {
+			t.Errorf("result %d: unexpected location %+v", i, r.Location)
+		}
+	}
+}
+
+func TestQueryBatchCancelled(t *testing.T) {
+	// Without workers, the batch blocks on the third valid address once the queue is full
+	g := newTestGeo(t, 2, BackpressureFail)
+	ctx, cancel := context.WithCancel(context.Background())
+	ips := []net.IP{net.ParseIP("1.2.3.4"), net.IP{1, 2}, net.ParseIP("1.2.3.4"), net.ParseIP("1.2.3.4"), net.IP{1, 2}}
+	done := make(chan []BatchResult)
+	go func() {
+		done <- g.QueryBatch(ctx, ips)
+	}()
+	for g.QueueDepth() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	results := <-done
+	expected := []error{context.Canceled, ErrInvalidIP, context.Canceled, context.Canceled, context.Canceled}
+	for i, r := range results {
+		if r.Err != expected[i] || r.Location != nil {
+			t.Errorf("result %d: expected error %v, got %v", i, expected[i], r.Err)
+		}
+	}
+}
+
+func TestQueryNotLoaded(t *testing.T) {
+	// Queries are answered right away before anything loads, rather than waiting for a load which may never happen
+	g := &Geo{lg: polychromatic.GetLogger("test"), queries: make(chan *Query, 1)}
+	rt := newRuntime(1)
+	rt.wg.Add(1)
+	go queryworker(rt, g)
+	defer func() {
+		rt.stop <- true
+		rt.wg.Wait()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	results := g.QueryBatch(ctx, []net.IP{net.ParseIP("1.2.3.4")})
+	if results[0].Err != ErrNotLoaded {
+		t.Errorf("expected ErrNotLoaded before any database has loaded, got %v", results[0].Err)
+	}
+}
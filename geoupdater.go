@@ -27,12 +27,14 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/gob"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"github.com/sirupsen/logrus"
 	"github.com/tenta-browser/polychromatic"
+	"hash"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -40,11 +42,19 @@ import (
 	"time"
 )
 
+var validVersion = regexp.MustCompile("^[A-Za-z0-9._-]+$")
+
 func geoupdater(cfg Config, rt *runtime, g *Geo) {
 	defer rt.wg.Done()
-	rt.wg.Add(1)
 	lg := polychromatic.GetLogger("geoupdater")
-	products := [2]string{"GeoIP2-City", "GeoIP2-ISP"}
+	products := g.editions
+	src := cfg.GeoSource
+	if src == nil {
+		src = newMaxMindSourceFromConfig(cfg)
+	}
+	if hs, ok := src.(httpSource); ok {
+		hs.setFetcher(newFetcher(cfg, rt.done))
+	}
 	lg.Debug("Starting up")
 	ticker := time.NewTicker(cfg.MaxMindUpdateInterval)
 	for {
@@ -63,146 +73,16 @@ func geoupdater(cfg Config, rt *runtime, g *Geo) {
 		successful := 0
 		uptodate := 0
 		for _, product := range products {
-			var err error
-			var url, dbfilename string
-			var newmd5, oldmd5 []byte
-			var resp *http.Response
-			var archive *gzip.Reader
-			var tr *tar.Reader
-			lg.Debugf("Checking for updates to %s", product)
-			url = fmt.Sprintf(cfg.MaxMindUrlTemplate, product, "tar.gz.md5", cfg.MaxMindKey)
-			lg.Debugf("Checking %s", url)
-			resp, err = http.Get(url)
-			if err != nil {
-				lg.Warnf("Failed fetching %s: %s", url, err.Error())
-				goto DONE
-			}
-			newmd5, err = ioutil.ReadAll(resp.Body)
-			resp.Body.Close()
-			if err != nil {
-				lg.Warnf("Failed reading %s: %s", url, err.Error())
-				goto DONE
-			}
-			if string(newmd5) == "Invalid license key\n" {
-				lg.Warnf("Invalid license key for %s", product)
-				err = errors.New("invalid license key")
-				goto DONE
-			}
-			lg.Debugf("New hash for %s is %s", product, newmd5)
-
-			if vererr == nil {
-				if strings.Contains(strings.ToLower(product), "city") {
-					oldmd5 = []byte(verinfo.City)
-				} else if strings.Contains(strings.ToLower(product), "isp") {
-					oldmd5 = []byte(verinfo.Isp)
-				}
-			} else {
-				oldmd5 = make([]byte, 0)
-			}
-
-			dbfilename = filepath.Join(cfg.GeoDBPath, fmt.Sprintf("%s-%s.mmdb", product, newmd5))
-			if bytes.Compare(oldmd5, newmd5) == 0 {
-				if _, err := os.Stat(dbfilename); err == nil {
-					uptodate += 1
-					lg.Debugf("Nothing to do, %s is up to date", product)
-					goto DONE
-				}
-				lg.Warnf("Database isn't updated, but %s is missing", dbfilename)
-			}
-			lg.Debugf("Need to update the underlying database %s", dbfilename)
-			url = fmt.Sprintf(cfg.MaxMindUrlTemplate, product, "tar.gz", cfg.MaxMindKey)
-			lg.Debugf("Fetching from %s", url)
-			resp, err = http.Get(url)
-			if err != nil {
-				lg.Warnf("Failed to download database %s from %s: %s", dbfilename, url, err.Error())
-				goto DONE
-			}
-			archive, err = gzip.NewReader(resp.Body)
-			if err != nil {
-				lg.Warnf("Failed to open return data as a gzip file %s: %s", url, err.Error())
-				resp.Body.Close()
-				goto DONE
-			}
-			tr = tar.NewReader(archive)
-
-			for {
-				header, innerErr := tr.Next()
-				if innerErr == io.EOF {
-					goto DONE
-				}
-				if innerErr != nil {
-					err = innerErr
-					goto DONE
-				}
-
-				if matched, _ := regexp.MatchString("^.*mmdb$", header.Name); matched {
-					lg.Debugf("Found DB File: %s (%d bytes), writing to %s", header.Name, header.Size, dbfilename)
-
-					fhandle, innerErr := os.OpenFile(dbfilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
-					if innerErr != nil {
-						lg.Warnf("Error opening geo database file %s for writing: %s", dbfilename, innerErr.Error())
-						err = innerErr
-						goto DONE
-					}
-
-					size, innerErr := io.Copy(fhandle, tr)
-					if innerErr != nil {
-						fhandle.Close()
-						err = innerErr
-						lg.Warnf("Error writing out geo database file %s: %s", dbfilename, innerErr.Error())
-						goto DONE
-					}
-
-					lg.Debugf("Successfully updated %d bytes into %s", size, dbfilename)
-					fhandle.Close()
-
-					if strings.Contains(strings.ToLower(product), "city") {
-						verinfo.City = string(newmd5)
-					} else if strings.Contains(strings.ToLower(product), "isp") {
-						verinfo.Isp = string(newmd5)
-					}
-
-					buf := new(bytes.Buffer)
-					innerErr = gob.NewEncoder(buf).Encode(verinfo)
-					if innerErr != nil {
-						err = innerErr
-						lg.Warnf("Error encoding geo file %s version: %s", dbfilename, innerErr.Error())
-						goto DONE
-					}
-					innerErr = ioutil.WriteFile(versionfile, buf.Bytes(), 0755)
-					if innerErr != nil {
-						err = innerErr
-						lg.Warnf("Error writing geo file %s version to %s: %s", dbfilename, versionfile, innerErr.Error())
-						goto DONE
-					}
-
-					if bytes.Compare(oldmd5, newmd5) != 0 {
-						oldfilename := filepath.Join(cfg.GeoDBPath, fmt.Sprintf("%s-%s.mmdb", product, oldmd5))
-
-						if _, innerErr := os.Stat(oldfilename); innerErr == nil {
-							lg.Debugf("Removing old geo database file %s", oldfilename)
-							innerErr = os.Remove(oldfilename)
-							if innerErr != nil {
-								lg.Warnf("Error removing old geo database file %s: %s", oldfilename, innerErr.Error())
-							}
-						}
-					}
-					break
-				}
-			}
-			successful += 1
-		DONE:
-			if archive != nil {
-				archive.Close()
-			}
-			if resp != nil && resp.Body != nil {
-				resp.Body.Close()
-			}
+			updated, err := updateEdition(cfg, src, product, verinfo, lg)
 			if err != nil {
 				lg.Errorf("Failed updating %s: %s", product, err.Error())
+			} else if updated {
+				successful += 1
+			} else {
+				uptodate += 1
 			}
 		}
-		if successful > 0 || (!g.loaded && uptodate > 0) {
+		if successful > 0 || (!g.Loaded() && uptodate > 0) {
 			lg.Debugf("Did a successful update, notifying Geo and updating database")
 			select {
 			case g.reload <- true:
@@ -221,3 +101,177 @@ func geoupdater(cfg Config, rt *runtime, g *Geo) {
 		}
 	}
 }
+
+// updateEdition brings a single edition up to date with the source, recording the new version in verinfo and the
+// version file. Returns whether anything was installed.
+func updateEdition(cfg Config, src DatabaseSource, product string, verinfo *VersionData, lg *logrus.Entry) (bool, error) {
+	lg.Debugf("Checking for updates to %s", product)
+	newver, err := src.Version(product)
+	if err != nil {
+		return false, err
+	}
+	if !validVersion.MatchString(newver) {
+		return false, fmt.Errorf("unusable version %q", newver)
+	}
+	lg.Debugf("New version of %s is %s", product, newver)
+
+	oldver := verinfo.version(product)
+	dbfilename := filepath.Join(cfg.GeoDBPath, fmt.Sprintf("%s-%s.mmdb", product, newver))
+	if oldver == newver {
+		if _, err := os.Stat(dbfilename); err == nil {
+			lg.Debugf("Nothing to do, %s is up to date", product)
+			return false, nil
+		}
+		lg.Warnf("Database isn't updated, but %s is missing", dbfilename)
+	}
+
+	lg.Debugf("Need to update the underlying database %s", dbfilename)
+	art, err := src.Fetch(product, newver)
+	if err != nil {
+		return false, fmt.Errorf("failed to download database %s: %s", dbfilename, err.Error())
+	}
+	defer art.Body.Close()
+
+	if err = installArtifact(art, product, dbfilename, lg); err != nil {
+		return false, err
+	}
+
+	verinfo.setVersion(product, newver)
+	buf := new(bytes.Buffer)
+	if err = gob.NewEncoder(buf).Encode(verinfo); err != nil {
+		return false, fmt.Errorf("error encoding geo file %s version: %s", dbfilename, err.Error())
+	}
+	versionfile := filepath.Join(cfg.GeoDBPath, versionDataFilename)
+	if err = writeFileAtomic(versionfile, buf.Bytes(), 0755); err != nil {
+		return false, fmt.Errorf("error writing geo file %s version to %s: %s", dbfilename, versionfile, err.Error())
+	}
+
+	if oldver != "" && oldver != newver {
+		oldfilename := filepath.Join(cfg.GeoDBPath, fmt.Sprintf("%s-%s.mmdb", product, oldver))
+		if _, err := os.Stat(oldfilename); err == nil {
+			lg.Debugf("Removing old geo database file %s", oldfilename)
+			if err = os.Remove(oldfilename); err != nil {
+				lg.Warnf("Error removing old geo database file %s: %s", oldfilename, err.Error())
+			}
+		}
+	}
+	return true, nil
+}
+
+// installArtifact unpacks the database from an artifact and installs it as dbfilename. The database is written to a
+// temporary file alongside, and only renamed into place once it's been synced to disk, matched against the published
+// checksum (if the source has one), and opened successfully as the expected edition. The final path therefore either
+// doesn't exist or holds a complete, usable database.
+func installArtifact(art *Artifact, edition, dbfilename string, lg *logrus.Entry) error {
+	var body io.Reader = art.Body
+	var hasher hash.Hash
+	if art.Checksum != "" && art.Hash != nil {
+		hasher = art.Hash()
+		body = io.TeeReader(art.Body, hasher)
+	}
+
+	var db io.Reader = body
+	if art.Format == FormatTarGz {
+		archive, err := gzip.NewReader(body)
+		if err != nil {
+			return fmt.Errorf("failed to open artifact as a gzip file: %s", err.Error())
+		}
+		defer archive.Close()
+		tr := tar.NewReader(archive)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				return errors.New("no database file found in archive")
+			}
+			if err != nil {
+				return err
+			}
+			if strings.HasSuffix(header.Name, "mmdb") {
+				lg.Debugf("Found DB File: %s (%d bytes), writing to %s", header.Name, header.Size, dbfilename)
+				db = tr
+				break
+			}
+		}
+	}
+
+	tmpfilename, size, err := writeTempFile(filepath.Dir(dbfilename), db)
+	if err != nil {
+		return fmt.Errorf("error writing out geo database file %s: %s", dbfilename, err.Error())
+	}
+	defer os.Remove(tmpfilename) // Harmless once it's been renamed away
+
+	if hasher != nil {
+		// Whatever follows the database in the archive is covered by the checksum too
+		if _, err = io.Copy(ioutil.Discard, body); err != nil {
+			return fmt.Errorf("error reading artifact for %s: %s", dbfilename, err.Error())
+		}
+		if sum := hex.EncodeToString(hasher.Sum(nil)); !strings.EqualFold(sum, art.Checksum) {
+			return fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, art.Checksum, sum)
+		}
+		lg.Debugf("Verified checksum %s", art.Checksum)
+	}
+
+	r, err := openDatabase(tmpfilename, edition)
+	if err != nil {
+		return err
+	}
+	r.Close()
+
+	// Temporary files are private, but the database may be shared with other users of GeoDBPath
+	if err = os.Chmod(tmpfilename, 0755); err != nil {
+		return fmt.Errorf("error setting permissions of geo database file %s: %s", dbfilename, err.Error())
+	}
+	if err = os.Rename(tmpfilename, dbfilename); err != nil {
+		return fmt.Errorf("error moving geo database file into place at %s: %s", dbfilename, err.Error())
+	}
+	syncDir(filepath.Dir(dbfilename))
+	lg.Debugf("Successfully updated %d bytes into %s", size, dbfilename)
+	return nil
+}
+
+// writeTempFile writes the content of r to a new temporary file in dir, and makes sure it's on disk before returning
+// its name. The file is removed again on failure.
+func writeTempFile(dir string, r io.Reader) (string, int64, error) {
+	fhandle, err := ioutil.TempFile(dir, ".geotor-")
+	if err != nil {
+		return "", 0, err
+	}
+	size, err := io.Copy(fhandle, r)
+	if err == nil {
+		err = fhandle.Sync()
+	}
+	if closeErr := fhandle.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(fhandle.Name())
+		return "", 0, err
+	}
+	return fhandle.Name(), size, nil
+}
+
+// writeFileAtomic replaces filename with data, such that readers only ever see the old or the new content
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmpfilename, _, err := writeTempFile(filepath.Dir(filename), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(tmpfilename, perm); err == nil {
+		err = os.Rename(tmpfilename, filename)
+	}
+	if err != nil {
+		os.Remove(tmpfilename)
+		return err
+	}
+	syncDir(filepath.Dir(filename))
+	return nil
+}
+
+// syncDir flushes a directory's entries, so that a rename survives a crash. Not every platform supports this,
+// and the rename has already happened either way, so errors are ignored.
+func syncDir(dir string) {
+	if dhandle, err := os.Open(dir); err == nil {
+		dhandle.Sync()
+		dhandle.Close()
+	}
+}
@@ -0,0 +1,125 @@
+/**
+ * GeoTor
+ *
+ *    Copyright 2018 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * geoupdater_test.go: Geo database updater tests
+ */
+
+package geotor
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/tenta-browser/polychromatic"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func makeArchive(t *testing.T, content []byte) []byte {
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: "GeoIP2-City_20180101/GeoIP2-City.mmdb", Mode: 0644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(content)
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestInstallArtifactRejects(t *testing.T) {
+	lg := polychromatic.GetLogger("test")
+	dir, err := ioutil.TempDir("", "geotor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := makeArchive(t, []byte("not really a database"))
+	sum := sha256.Sum256(archive)
+	dbfilename := filepath.Join(dir, "GeoIP2-City-test.mmdb")
+
+	bad := &Artifact{Body: ioutil.NopCloser(bytes.NewReader(archive)), Format: FormatTarGz, Checksum: hex.EncodeToString(make([]byte, 32)), Hash: sha256.New}
+	if err := installArtifact(bad, "GeoIP2-City", dbfilename, lg); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected a checksum mismatch, got %v", err)
+	}
+
+	invalid := &Artifact{Body: ioutil.NopCloser(bytes.NewReader(archive)), Format: FormatTarGz, Checksum: hex.EncodeToString(sum[:]), Hash: sha256.New}
+	if err := installArtifact(invalid, "GeoIP2-City", dbfilename, lg); err == nil || errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected an invalid database error, got %v", err)
+	}
+
+	// Neither the database nor any temporary files should have been left behind
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("rejected installs left %d files behind", len(files))
+	}
+}
+
+func TestInstallArtifact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geotor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := makeArchive(t, testDatabase(EditionGeoIP2City))
+	sum := sha256.Sum256(archive)
+	dbfilename := filepath.Join(dir, "GeoIP2-City-test.mmdb")
+	art := &Artifact{Body: ioutil.NopCloser(bytes.NewReader(archive)), Format: FormatTarGz, Checksum: hex.EncodeToString(sum[:]), Hash: sha256.New}
+	if err := installArtifact(art, EditionGeoIP2City, dbfilename, polychromatic.GetLogger("test")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dbfilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("installed database has mode %s, expected it to be readable by everyone", info.Mode().Perm())
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("expected only the database, found %d files", len(files))
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geotor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, versionDataFilename)
+	for _, content := range []string{"first", "second"} {
+		if err := writeFileAtomic(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if written, _ := ioutil.ReadFile(filename); string(written) != content {
+			t.Errorf("expected %q, read %q", content, written)
+		}
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("expected only the version file, found %d files", len(files))
+	}
+}
@@ -0,0 +1,130 @@
+/**
+ * GeoTor
+ *
+ *    Copyright 2018 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * locale.go: Locale negotiation
+ */
+
+package geotor
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultLocale = "en"
+
+// parseAcceptLanguage turns an Accept-Language style list, e.g. "pt-BR, pt;q=0.9, en;q=0.5", into locales ordered
+// by preference. Entries with a zero or malformed quality, and the "*" wildcard, are dropped.
+func parseAcceptLanguage(accept string) []string {
+	type weighted struct {
+		locale string
+		q      float64
+	}
+	entries := make([]weighted, 0)
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		locale := strings.TrimSpace(fields[0])
+		if locale == "" || locale == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				var err error
+				if q, err = strconv.ParseFloat(param[2:], 64); err != nil {
+					q = 0
+				}
+			}
+		}
+		if q > 0 {
+			entries = append(entries, weighted{locale: locale, q: q})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].q > entries[j].q
+	})
+	ret := make([]string, len(entries))
+	for i, e := range entries {
+		ret[i] = e.locale
+	}
+	return ret
+}
+
+// baseLanguage strips any region or script from a locale, e.g. zh-CN becomes zh
+func baseLanguage(locale string) string {
+	if i := strings.IndexAny(locale, "-_"); i > 0 {
+		return locale[:i]
+	}
+	return locale
+}
+
+// normalizeLocale puts a locale tag in the form used for fallback chain keys, e.g. zh_HK becomes zh-hk
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.Replace(locale, "_", "-", -1))
+}
+
+// newLocaleFallbacks prepares the configured fallback chains, keyed by normalized locale so that they apply however
+// the client spells the tag
+func newLocaleFallbacks(fallbacks map[string][]string) map[string][]string {
+	ret := make(map[string][]string, len(fallbacks))
+	for locale, chain := range fallbacks {
+		ret[normalizeLocale(locale)] = chain
+	}
+	return ret
+}
+
+// resolveLocale picks the best of the available locales for the preference list. Each preferred locale is tried
+// as is, then along its fallback chain (from fallbacks, which newLocaleFallbacks prepares, or just its base language
+// if it has none configured), where a bare language also matches any regional variant, e.g. pt matches pt-BR.
+// English is the last resort.
+func resolveLocale(prefs []string, fallbacks map[string][]string, available []string) string {
+	match := func(locale string) (string, bool) {
+		for _, a := range available {
+			if strings.EqualFold(a, locale) {
+				return a, true
+			}
+		}
+		if baseLanguage(locale) == locale {
+			for _, a := range available {
+				if strings.EqualFold(baseLanguage(a), locale) {
+					return a, true
+				}
+			}
+		}
+		return "", false
+	}
+
+	for _, pref := range prefs {
+		chain, ok := fallbacks[normalizeLocale(pref)]
+		if !ok {
+			chain = []string{baseLanguage(pref)}
+		}
+		if found, ok := match(pref); ok {
+			return found
+		}
+		for _, locale := range chain {
+			if found, ok := match(locale); ok {
+				return found
+			}
+		}
+	}
+	return defaultLocale
+}
@@ -0,0 +1,58 @@
+/**
+ * GeoTor
+ *
+ *    Copyright 2018 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * locale_test.go: Locale negotiation tests
+ */
+
+package geotor
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLocaleNegotiation(t *testing.T) {
+	prefs := parseAcceptLanguage("en;q=0.5, *, pt-BR, fr;q=0, pt;q=0.9")
+	if !reflect.DeepEqual(prefs, []string{"pt-BR", "pt", "en"}) {
+		t.Errorf("unexpected preference order %v", prefs)
+	}
+
+	available := []string{"de", "en", "pt-BR", "zh-CN"}
+	cases := []struct {
+		accept string
+		want   string
+	}{
+		{"pt", "pt-BR"},
+		{"zh-TW", "zh-CN"},
+		{"ja", "en"},
+		{"zh-HK", "zh-CN"},
+		{"gsw-CH", "de"},
+		{"gsw-ch", "de"},
+		{"GSW_CH", "de"},
+		{"gsw", "en"},
+		{"fr, DE;q=0.8", "de"},
+		{"", "en"},
+	}
+	fallbacks := newLocaleFallbacks(map[string][]string{"zh-HK": {"zh-TW", "zh"}, "gsw-CH": {"de"}})
+	for _, c := range cases {
+		if got := resolveLocale(parseAcceptLanguage(c.accept), fallbacks, available); got != c.want {
+			t.Errorf("%q resolved to %q, expected %q", c.accept, got, c.want)
+		}
+	}
+}
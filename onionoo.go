@@ -0,0 +1,152 @@
+/**
+ * GeoTor
+ *
+ *    Copyright 2018 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * onionoo.go: Onionoo relay details parsing
+ */
+
+package geotor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// onionooDetails is the part of an Onionoo details document we use, see https://metrics.torproject.org/onionoo.html
+type onionooDetails struct {
+	RelaysPublished string         `json:"relays_published"`
+	Relays          []onionooRelay `json:"relays"`
+}
+
+type onionooRelay struct {
+	Nickname            string          `json:"nickname"`
+	Fingerprint         string          `json:"fingerprint"`
+	ORAddresses         []string        `json:"or_addresses"`
+	ExitAddresses       []string        `json:"exit_addresses"`
+	LastSeen            string          `json:"last_seen"`
+	Flags               []string        `json:"flags"`
+	Country             string          `json:"country"`
+	ObservedBandwidth   uint64          `json:"observed_bandwidth"`
+	ExitPolicy          []string        `json:"exit_policy"`
+	ExitPolicySummary   *onionooSummary `json:"exit_policy_summary"`
+	ExitPolicyV6Summary *onionooSummary `json:"exit_policy_v6_summary"`
+}
+
+type onionooSummary struct {
+	Accept []string `json:"accept"`
+	Reject []string `json:"reject"`
+}
+
+// exitPolicy collects whatever parts of the relay's exit policy Onionoo provides, or nil if it provides none
+func (r *onionooRelay) exitPolicy() (*ExitPolicy, error) {
+	if r.ExitPolicy == nil && r.ExitPolicySummary == nil && r.ExitPolicyV6Summary == nil {
+		return nil, nil
+	}
+	ret := &ExitPolicy{Rules: make([]ExitPolicyRule, 0, len(r.ExitPolicy))}
+	for _, line := range r.ExitPolicy {
+		rule, err := parseExitPolicyRule(line)
+		if err != nil {
+			return nil, err
+		}
+		ret.Rules = append(ret.Rules, rule)
+	}
+	var err error
+	if r.ExitPolicySummary != nil {
+		if ret.SummaryV4, err = newPolicySummary(r.ExitPolicySummary.Accept, r.ExitPolicySummary.Reject); err != nil {
+			return nil, err
+		}
+	}
+	if r.ExitPolicyV6Summary != nil {
+		if ret.SummaryV6, err = newPolicySummary(r.ExitPolicyV6Summary.Accept, r.ExitPolicyV6Summary.Reject); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// exitsFromOR decides whether connections may exit from one of a relay's OR addresses, which is the case if its
+// policy summary for the address family accepts any port at all. The Exit flag is only used for relays without a
+// summary, as tor reserves it for relays exiting to several common ports, so a relay only exiting to 443 lacks it.
+// Relays flagged BadExit are included: clients avoid them, but they still carry traffic, so callers which want to
+// discount them should check HasFlag("BadExit").
+func exitsFromOR(node *TorNode, ip net.IP) bool {
+	if p := node.ExitPolicy; p != nil && (p.SummaryV4 != nil || p.SummaryV6 != nil) {
+		if ip.To4() != nil {
+			return p.SummaryV4.acceptsAny()
+		}
+		return p.SummaryV6.acceptsAny()
+	}
+	return node.HasFlag("Exit")
+}
+
+// parseonionoo turns an Onionoo details document into nodes, one per relay. Exits connect out from their OR
+// addresses, and from any exit addresses, which are addresses tor has actually seen traffic exit from.
+func parseonionoo(body []byte) ([]*TorNode, error) {
+	var details onionooDetails
+	if err := json.Unmarshal(body, &details); err != nil {
+		return nil, fmt.Errorf("unable to parse onionoo details: %s", err.Error())
+	}
+	if details.Relays == nil {
+		return nil, errors.New("onionoo details contain no relays")
+	}
+	published := parsetortime(details.RelaysPublished)
+
+	ret := make([]*TorNode, 0, len(details.Relays))
+	for _, relay := range details.Relays {
+		node := NewTorNode()
+		node.NodeId = relay.Fingerprint
+		node.Nickname = relay.Nickname
+		node.Published = published
+		node.Updated = parsetortime(relay.LastSeen)
+		node.Flags = relay.Flags
+		node.Country = relay.Country
+		node.Bandwidth = relay.ObservedBandwidth
+		if policy, err := relay.exitPolicy(); err == nil {
+			// A policy we can't make sense of is left unknown rather than dropping the relay
+			node.ExitPolicy = policy
+		}
+
+		for _, addr := range relay.ORAddresses {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				continue
+			}
+			ip := net.ParseIP(host)
+			portnum, err := strconv.Atoi(port)
+			if ip == nil || err != nil {
+				continue
+			}
+			node.ORAddresses = append(node.ORAddresses, ORAddress{IP: ip, Port: portnum})
+		}
+		for _, addr := range node.ORAddresses {
+			if exitsFromOR(node, addr.IP) {
+				node.Addresses = append(node.Addresses, ExitAddress{IP: addr.IP, Date: node.Updated})
+			}
+		}
+		for _, addr := range relay.ExitAddresses {
+			if ip := net.ParseIP(addr); ip != nil {
+				node.Addresses = append(node.Addresses, ExitAddress{IP: ip, Date: node.Updated})
+			}
+		}
+		ret = append(ret, node)
+	}
+	return ret, nil
+}
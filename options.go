@@ -0,0 +1,86 @@
+/**
+ * GeoTor
+ *
+ *    Copyright 2018 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * options.go: Per query options
+ */
+
+package geotor
+
+// LookupOption customizes a single query
+type LookupOption func(*lookupOptions)
+
+// Field selects parts of a GeoLocation. Fields which aren't requested are left empty, and their databases aren't
+// consulted at all, or only as far as the requested fields need.
+type Field uint
+
+const (
+	// FieldCountry is CountryISO, CountryGeoNameID and IsInEuropeanUnion, without any names
+	FieldCountry Field = 1 << iota
+	// FieldPosition is Position
+	FieldPosition
+	// FieldLocation is the entire city record, including the names, Location and LocationI18n. It implies
+	// FieldCountry and FieldPosition.
+	FieldLocation
+	// FieldNetwork is ISP
+	FieldNetwork
+	// FieldAnonymity is the Anonymity flags from the anonymous IP database
+	FieldAnonymity
+	// FieldConnectionType is ConnectionType
+	FieldConnectionType
+	// FieldDomain is Domain
+	FieldDomain
+	// FieldTor is TorNode, and the tor flags of Anonymity
+	FieldTor
+
+	FieldAll = FieldCountry | FieldPosition | FieldLocation | FieldNetwork | FieldAnonymity | FieldConnectionType |
+		FieldDomain | FieldTor
+)
+
+type lookupOptions struct {
+	negotiate bool     // Resolve a single locale rather than building LocationI18n
+	languages []string // Preferred locales, in order
+	fields    Field
+}
+
+func newLookupOptions(opts []LookupOption) *lookupOptions {
+	ret := &lookupOptions{fields: FieldAll}
+	for _, opt := range opts {
+		opt(ret)
+	}
+	return ret
+}
+
+// WithLanguages asks for location strings in a single locale, negotiated from an Accept-Language style preference
+// list such as "pt-BR, pt;q=0.9, en;q=0.5". The result carries the chosen locale in GeoLocation.Locale, and City,
+// Country, Location and the names in the rest of the city record are in that locale. LocationI18n is left empty,
+// which saves building it.
+func WithLanguages(accept string) LookupOption {
+	return func(o *lookupOptions) {
+		o.negotiate = true
+		o.languages = parseAcceptLanguage(accept)
+	}
+}
+
+// WithFields restricts a query to the specified fields, e.g. WithFields(FieldCountry|FieldTor), skipping the
+// lookups and decoding needed for the rest. Sources only lists the sections which were consulted.
+func WithFields(fields Field) LookupOption {
+	return func(o *lookupOptions) {
+		o.fields = fields
+	}
+}
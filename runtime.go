@@ -29,13 +29,19 @@ import (
 const runtimeStartedServices = 3
 
 type runtime struct {
-	wg      *sync.WaitGroup
-	stop    chan bool
+	wg       *sync.WaitGroup
+	stop     chan bool
+	done     chan struct{} // Closed on shutdown, for anything waiting outside of the service loops
+	services int
 }
 
-func newRuntime() *runtime {
+// newRuntime creates a runtime for the fixed services plus the given number of query workers
+func newRuntime(workers int) *runtime {
+	services := runtimeStartedServices + workers
 	return &runtime{
-		wg:      &sync.WaitGroup{},
-		stop:    make(chan bool, runtimeStartedServices),
+		wg:       &sync.WaitGroup{},
+		stop:     make(chan bool, services),
+		done:     make(chan struct{}),
+		services: services,
 	}
 }
\ No newline at end of file
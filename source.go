@@ -0,0 +1,344 @@
+/**
+ * GeoTor
+ *
+ *    Copyright 2018 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * source.go: Geo database sources
+ */
+
+package geotor
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ArtifactFormat describes how a database is packaged by a source
+type ArtifactFormat int
+
+const (
+	// FormatTarGz is a gzipped tarball containing the .mmdb file, as MaxMind distributes them
+	FormatTarGz ArtifactFormat = iota
+	// FormatMMDB is a bare .mmdb file
+	FormatMMDB
+)
+
+// Artifact is a single downloaded copy of a database. The consumer must close Body.
+type Artifact struct {
+	Body     io.ReadCloser
+	Format   ArtifactFormat
+	Checksum string           // Published hex digest of Body, if the source has one
+	Hash     func() hash.Hash // Algorithm used to compute Checksum
+}
+
+// DatabaseSource supplies database editions (e.g. GeoIP2-City) to the updater
+type DatabaseSource interface {
+	// Version identifies the currently available version of edition. It must change whenever the content does,
+	// and only contain characters which are safe to use in a filename.
+	Version(edition string) (string, error)
+	// Fetch retrieves the specified version of edition
+	Fetch(edition, version string) (*Artifact, error)
+}
+
+var (
+	ErrEditionNotAvailable = errors.New("edition not available from this source")
+	ErrChecksumMismatch    = errors.New("downloaded database does not match its published checksum")
+)
+
+// MaxMindPermalinkTemplate is the MaxMind download service's current URL scheme, formatted with the edition and suffix
+const MaxMindPermalinkTemplate = "https://download.maxmind.com/geoip/databases/%s/download?suffix=%s"
+
+var validSHA256 = regexp.MustCompile("^[0-9a-fA-F]{64}$")
+
+// httpSource is implemented by the built in sources which download over HTTP, so that the updater can hand them a
+// fetcher set up according to the config
+type httpSource interface {
+	setFetcher(f *fetcher)
+}
+
+// MaxMindSource fetches databases from the MaxMind download service. With an AccountID, it uses the permalink API
+// with basic auth and SHA256 checksums, otherwise the legacy API with the license key in the URL and MD5 checksums.
+type MaxMindSource struct {
+	UrlTemplate       string // Legacy API, formatted with the edition, suffix and license key
+	PermalinkTemplate string // Permalink API, formatted with the edition and suffix
+	AccountID         string
+	Key               string
+	fetch             *fetcher
+}
+
+// NewMaxMindSource creates a source using the legacy, license key in URL, download API
+func NewMaxMindSource(urltemplate, key string) *MaxMindSource {
+	return &MaxMindSource{UrlTemplate: urltemplate, Key: key, fetch: defaultFetcher()}
+}
+
+// NewMaxMindAccountSource creates a source using the permalink download API, authenticated with an account ID
+func NewMaxMindAccountSource(accountid, key string) *MaxMindSource {
+	return &MaxMindSource{PermalinkTemplate: MaxMindPermalinkTemplate, AccountID: accountid, Key: key, fetch: defaultFetcher()}
+}
+
+// newMaxMindSourceFromConfig picks the API to use based on whether an account ID is configured
+func newMaxMindSourceFromConfig(cfg Config) *MaxMindSource {
+	if cfg.MaxMindAccountID != "" {
+		m := NewMaxMindAccountSource(cfg.MaxMindAccountID, cfg.MaxMindKey)
+		if cfg.MaxMindPermalinkTemplate != "" {
+			m.PermalinkTemplate = cfg.MaxMindPermalinkTemplate
+		}
+		return m
+	}
+	return NewMaxMindSource(cfg.MaxMindUrlTemplate, cfg.MaxMindKey)
+}
+
+func (m *MaxMindSource) setFetcher(f *fetcher) {
+	m.fetch = f
+}
+
+func (m *MaxMindSource) request(edition, suffix string) (*http.Request, error) {
+	if m.AccountID == "" {
+		return http.NewRequest(http.MethodGet, fmt.Sprintf(m.UrlTemplate, edition, suffix, m.Key), nil)
+	}
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf(m.PermalinkTemplate, edition, suffix), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(m.AccountID, m.Key)
+	return req, nil
+}
+
+// checksum fetches a checksum file, which is only downloaded again once it changes
+func (m *MaxMindSource) checksum(edition, suffix string) ([]byte, error) {
+	req, err := m.request(edition, suffix)
+	if err != nil {
+		return nil, err
+	}
+	body, _, err := m.fetch.fetchCached(req)
+	if string(body) == "Invalid license key\n" {
+		return nil, errors.New("invalid license key")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed fetching %s checksum: %s", edition, err.Error())
+	}
+	return body, nil
+}
+
+func (m *MaxMindSource) Version(edition string) (string, error) {
+	if m.AccountID != "" {
+		return m.sha256Version(edition)
+	}
+	newmd5, err := m.checksum(edition, "tar.gz.md5")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(newmd5)), nil
+}
+
+// sha256Version fetches the published checksum file, formatted like sha256sum output: <hash>  <filename>
+func (m *MaxMindSource) sha256Version(edition string) (string, error) {
+	body, err := m.checksum(edition, "tar.gz.sha256")
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(body))
+	if len(fields) == 0 || !validSHA256.MatchString(fields[0]) {
+		return "", fmt.Errorf("malformed %s checksum %q", edition, body)
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+func (m *MaxMindSource) Fetch(edition, version string) (*Artifact, error) {
+	req, err := m.request(edition, "tar.gz")
+	if err != nil {
+		return nil, err
+	}
+	art, err := httpArtifact(m.fetch, req, FormatTarGz)
+	if err != nil {
+		return nil, err
+	}
+	art.Checksum = version
+	art.Hash = md5.New
+	if m.AccountID != "" {
+		art.Hash = sha256.New
+	}
+	return art, nil
+}
+
+// HTTPMirrorSource fetches databases from a plain web server, which serves each edition as
+// <BaseUrl>/<edition>.mmdb or <BaseUrl>/<edition>.tar.gz depending on Format. Versions are derived from the
+// ETag or Last-Modified headers, so the server must provide at least one of them.
+type HTTPMirrorSource struct {
+	BaseUrl string
+	Format  ArtifactFormat
+	fetch   *fetcher
+}
+
+func NewHTTPMirrorSource(baseurl string, format ArtifactFormat) *HTTPMirrorSource {
+	return &HTTPMirrorSource{BaseUrl: strings.TrimSuffix(baseurl, "/"), Format: format, fetch: defaultFetcher()}
+}
+
+func (h *HTTPMirrorSource) setFetcher(f *fetcher) {
+	h.fetch = f
+}
+
+func (h *HTTPMirrorSource) url(edition string) string {
+	if h.Format == FormatMMDB {
+		return fmt.Sprintf("%s/%s.mmdb", h.BaseUrl, edition)
+	}
+	return fmt.Sprintf("%s/%s.tar.gz", h.BaseUrl, edition)
+}
+
+func (h *HTTPMirrorSource) Version(edition string) (string, error) {
+	req, err := http.NewRequest(http.MethodHead, h.url(edition), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := h.fetch.fetch(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", ErrEditionNotAvailable
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status checking %s: %s", edition, resp.Status)
+	}
+	tag := resp.Header.Get("ETag")
+	if tag == "" {
+		tag = resp.Header.Get("Last-Modified")
+	}
+	if tag == "" {
+		return "", fmt.Errorf("mirror provides neither an ETag nor Last-Modified for %s", edition)
+	}
+	// Headers may contain anything, so hash them down to something we can put in a filename
+	sum := md5.Sum([]byte(tag))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (h *HTTPMirrorSource) Fetch(edition, version string) (*Artifact, error) {
+	req, err := http.NewRequest(http.MethodGet, h.url(edition), nil)
+	if err != nil {
+		return nil, err
+	}
+	return httpArtifact(h.fetch, req, h.Format)
+}
+
+// DirectorySource reads databases from a local directory, containing each edition as either <edition>.mmdb
+// or <edition>.tar.gz. Useful for air-gapped deployments, where the files are delivered out of band.
+type DirectorySource struct {
+	Path string
+}
+
+func NewDirectorySource(path string) *DirectorySource {
+	return &DirectorySource{Path: path}
+}
+
+func (d *DirectorySource) find(edition string) (string, ArtifactFormat, error) {
+	mmdb := filepath.Join(d.Path, edition+".mmdb")
+	if _, err := os.Stat(mmdb); err == nil {
+		return mmdb, FormatMMDB, nil
+	}
+	targz := filepath.Join(d.Path, edition+".tar.gz")
+	if _, err := os.Stat(targz); err == nil {
+		return targz, FormatTarGz, nil
+	}
+	return "", FormatMMDB, ErrEditionNotAvailable
+}
+
+func (d *DirectorySource) Version(edition string) (string, error) {
+	filename, _, err := d.find(edition)
+	if err != nil {
+		return "", err
+	}
+	return fileVersion(filename)
+}
+
+func (d *DirectorySource) Fetch(edition, version string) (*Artifact, error) {
+	filename, format, err := d.find(edition)
+	if err != nil {
+		return nil, err
+	}
+	return fileArtifact(filename, format, version)
+}
+
+// FileSource reads each edition from a specific .mmdb file
+type FileSource struct {
+	Files map[string]string // Edition to filename
+}
+
+func NewFileSource(files map[string]string) *FileSource {
+	return &FileSource{Files: files}
+}
+
+func (f *FileSource) Version(edition string) (string, error) {
+	filename, ok := f.Files[edition]
+	if !ok {
+		return "", ErrEditionNotAvailable
+	}
+	return fileVersion(filename)
+}
+
+func (f *FileSource) Fetch(edition, version string) (*Artifact, error) {
+	filename, ok := f.Files[edition]
+	if !ok {
+		return nil, ErrEditionNotAvailable
+	}
+	return fileArtifact(filename, FormatMMDB, version)
+}
+
+func httpArtifact(f *fetcher, req *http.Request, format ArtifactFormat) (*Artifact, error) {
+	resp, err := f.fetch(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status fetching %s: %s", req.URL.Redacted(), resp.Status)
+	}
+	return &Artifact{Body: resp.Body, Format: format}, nil
+}
+
+// fileArtifact opens a local file, which is expected to still match the md5 version it was advertised with
+func fileArtifact(filename string, format ArtifactFormat, version string) (*Artifact, error) {
+	fhandle, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &Artifact{Body: fhandle, Format: format, Checksum: version, Hash: md5.New}, nil
+}
+
+// fileVersion identifies a local file by the md5 of its content
+func fileVersion(filename string) (string, error) {
+	fhandle, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer fhandle.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, fhandle); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
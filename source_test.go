@@ -0,0 +1,223 @@
+/**
+ * GeoTor
+ *
+ *    Copyright 2018 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * source_test.go: Geo database source tests
+ */
+
+package geotor
+
+import (
+	"errors"
+	"github.com/tenta-browser/polychromatic"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMaxMindAccountSource(t *testing.T) {
+	const sum = "0123456789ABCDEF0123456789abcdef0123456789abcdef0123456789abcdef"
+	checksum := sum + "  GeoIP2-City_20240301.tar.gz\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, key, ok := r.BasicAuth()
+		if !ok || user != "1234" || key != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, "/geoip/databases/GeoIP2-City/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.URL.Query().Get("suffix") {
+		case "tar.gz.sha256":
+			w.Write([]byte(checksum))
+		case "tar.gz":
+			w.Write([]byte("archive"))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	m := NewMaxMindAccountSource("1234", "secret")
+	m.PermalinkTemplate = server.URL + "/geoip/databases/%s/download?suffix=%s"
+
+	version, err := m.Version(EditionGeoIP2City)
+	if err != nil {
+		t.Fatalf("version check failed: %s", err.Error())
+	}
+	if version != strings.ToLower(sum) {
+		t.Errorf("unexpected version %q", version)
+	}
+	art, err := m.Fetch(EditionGeoIP2City, version)
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(art.Body)
+	art.Body.Close()
+	if string(body) != "archive" || art.Checksum != version || art.Hash().Size() != 32 {
+		t.Errorf("unexpected artifact %q with checksum %q", body, art.Checksum)
+	}
+
+	wrong := NewMaxMindAccountSource("1234", "wrong")
+	wrong.PermalinkTemplate = m.PermalinkTemplate
+	if _, err := wrong.Version(EditionGeoIP2City); err == nil {
+		t.Error("version check succeeded with the wrong credentials")
+	}
+
+	for _, malformed := range []string{"", "not-a-checksum  GeoIP2-City.tar.gz\n", sum[:63] + "  GeoIP2-City.tar.gz\n"} {
+		checksum = malformed
+		m := NewMaxMindAccountSource("1234", "secret")
+		m.PermalinkTemplate = server.URL + "/geoip/databases/%s/download?suffix=%s"
+		if _, err := m.Version(EditionGeoIP2City); err == nil {
+			t.Errorf("malformed checksum %q accepted", malformed)
+		}
+	}
+}
+
+func TestHTTPMirrorSource(t *testing.T) {
+	etag, lastmodified := `"v1"`, ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/mirror/GeoIP2-City.mmdb" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		if lastmodified != "" {
+			w.Header().Set("Last-Modified", lastmodified)
+		}
+		w.Write([]byte("database"))
+	}))
+	defer server.Close()
+
+	h := NewHTTPMirrorSource(server.URL+"/mirror/", FormatMMDB)
+	versions := make(map[string]bool)
+	for _, validators := range [][2]string{{`"v1"`, ""}, {`"v2"`, ""}, {"", "Fri, 01 Mar 2024 00:00:00 GMT"}, {"", "Sat, 02 Mar 2024 00:00:00 GMT"}} {
+		etag, lastmodified = validators[0], validators[1]
+		version, err := h.Version(EditionGeoIP2City)
+		if err != nil {
+			t.Fatalf("version check failed with %v: %s", validators, err.Error())
+		}
+		if versions[version] || strings.ContainsAny(version, "/\\\" ") {
+			t.Errorf("version %q for %v is reused or unsafe in a filename", version, validators)
+		}
+		versions[version] = true
+	}
+
+	art, err := h.Fetch(EditionGeoIP2City, "")
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(art.Body)
+	art.Body.Close()
+	if string(body) != "database" || art.Format != FormatMMDB {
+		t.Errorf("unexpected artifact %q", body)
+	}
+
+	etag, lastmodified = "", ""
+	if _, err := h.Version(EditionGeoIP2City); err == nil {
+		t.Error("version derived from a response without validators")
+	}
+	if _, err := h.Version(EditionGeoIP2ISP); err != ErrEditionNotAvailable {
+		t.Errorf("expected ErrEditionNotAvailable for a missing edition, got %v", err)
+	}
+}
+
+func TestDirectorySource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geotor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := NewDirectorySource(dir)
+	if _, err := d.Version(EditionGeoIP2City); err != ErrEditionNotAvailable {
+		t.Errorf("expected ErrEditionNotAvailable for a missing edition, got %v", err)
+	}
+	if _, err := d.Fetch(EditionGeoIP2City, ""); err != ErrEditionNotAvailable {
+		t.Errorf("expected ErrEditionNotAvailable fetching a missing edition, got %v", err)
+	}
+
+	write("GeoIP2-City.mmdb", "first")
+	first, err := d.Version(EditionGeoIP2City)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("GeoIP2-City.mmdb", "second")
+	if second, _ := d.Version(EditionGeoIP2City); second == first {
+		t.Error("version didn't change with the content")
+	}
+
+	write("GeoIP2-ISP.tar.gz", "archive")
+	art, err := d.Fetch(EditionGeoIP2ISP, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	art.Body.Close()
+	if art.Format != FormatTarGz {
+		t.Error("tarball not fetched as one")
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geotor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "city.mmdb")
+	ioutil.WriteFile(filename, []byte("first"), 0644)
+
+	f := NewFileSource(map[string]string{EditionGeoIP2City: filename})
+	if _, err := f.Version(EditionGeoIP2ISP); err != ErrEditionNotAvailable {
+		t.Errorf("expected ErrEditionNotAvailable for a missing edition, got %v", err)
+	}
+	if _, err := f.Fetch(EditionGeoIP2ISP, ""); err != ErrEditionNotAvailable {
+		t.Errorf("expected ErrEditionNotAvailable fetching a missing edition, got %v", err)
+	}
+	version, err := f.Version(EditionGeoIP2City)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file changes between checking the version and fetching it
+	ioutil.WriteFile(filename, []byte("second"), 0644)
+	if changed, _ := f.Version(EditionGeoIP2City); changed == version {
+		t.Error("version didn't change with the content")
+	}
+	art, err := f.Fetch(EditionGeoIP2City, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer art.Body.Close()
+	err = installArtifact(art, EditionGeoIP2City, filepath.Join(dir, "installed.mmdb"), polychromatic.GetLogger("test"))
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected a checksum mismatch for a file changed after its version was taken, got %v", err)
+	}
+}
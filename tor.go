@@ -25,15 +25,23 @@ package geotor
 import (
 	"fmt"
 	"net"
+	"net/netip"
 	"time"
 )
 
-// Type TorNode represents a single node in the tor network.
+// Type TorNode represents a single node in the tor network. The exit list only describes exits, with just
+// NodeId, the dates and Addresses; the rest is only available from Onionoo.
 type TorNode struct {
-	NodeId    string
-	Published time.Time
-	Updated   time.Time
-	Addresses []ExitAddress
+	NodeId      string
+	Nickname    string
+	Published   time.Time
+	Updated     time.Time
+	Addresses   []ExitAddress // Addresses connections exit from, empty if the relay isn't an exit
+	ORAddresses []ORAddress   // Addresses the relay accepts connections from other relays and clients on
+	Flags       []string      // Directory flags, e.g. Exit, Guard, Fast
+	Country     string        // ISO code, lower case
+	Bandwidth   uint64        // Observed bandwidth, in bytes per second
+	ExitPolicy  *ExitPolicy   // Nil if unknown
 }
 
 // Type ExitAddress represents an IP address and active time
@@ -42,6 +50,12 @@ type ExitAddress struct {
 	Date time.Time
 }
 
+// Type ORAddress represents the address and port a relay listens on
+type ORAddress struct {
+	IP   net.IP
+	Port int
+}
+
 func NewTorNode() *TorNode {
 	return &TorNode{Addresses: make([]ExitAddress, 0)}
 }
@@ -50,28 +64,114 @@ func (t TorNode) String() string {
 	return fmt.Sprintf("TorNode %s with %d IPs", t.NodeId, len(t.Addresses))
 }
 
+// IsExit indicates whether connections may come from the node
+func (t *TorNode) IsExit() bool {
+	return len(t.Addresses) > 0
+}
+
+// exitsFrom indicates whether addr is one of the addresses connections exit from, as opposed to an OR address only
+func (t *TorNode) exitsFrom(addr netip.Addr) bool {
+	for _, exit := range t.Addresses {
+		if key, ok := canonicalAddr(exit.IP); ok && key == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// HasFlag indicates whether the node has the specified directory flag
+func (t *TorNode) HasFlag(flag string) bool {
+	for _, f := range t.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// ips lists every address of the node, exit and OR
+func (t *TorNode) ips() []net.IP {
+	ret := make([]net.IP, 0, len(t.Addresses)+len(t.ORAddresses))
+	for _, addr := range t.Addresses {
+		ret = append(ret, addr.IP)
+	}
+	for _, addr := range t.ORAddresses {
+		ret = append(ret, addr.IP)
+	}
+	return ret
+}
+
 var _ fmt.Stringer = TorNode{} // Verify that we're a stringer
 
 // Type TorHash implements a hash structure for TorNodes. It is not thread safe for writes, but will
-// tolerate concurrent readers.
+// tolerate concurrent readers. Addresses are keyed in canonical form, so an IPv4 address matches whether it's
+// given as 4 bytes or IPv4-mapped IPv6 (::ffff:1.2.3.4). An address may be shared by several nodes.
 type TorHash struct {
-	hash map[string]*TorNode
-	cnt  int
+	hash      map[netip.Addr][]*TorNode
+	nodes     map[string]*TorNode // By NodeId
+	anonymous int                 // Nodes without a NodeId, which can't be indexed
 }
 
 func NewTorHash() *TorHash {
-	return &TorHash{hash: make(map[string]*TorNode), cnt: 0}
+	return &TorHash{hash: make(map[netip.Addr][]*TorNode), nodes: make(map[string]*TorNode)}
+}
+
+// canonicalAddr converts ip to a map key, unmapping IPv4-mapped IPv6 addresses. Doesn't allocate.
+func canonicalAddr(ip net.IP) (netip.Addr, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	return addr.Unmap(), ok
 }
 
-// Adds a TorNode to the hash
+// Adds a TorNode to the hash, replacing any node previously added with the same NodeId
 func (t *TorHash) Add(node *TorNode) {
-	for _, addr := range node.Addresses {
-		t.hash[addr.IP.String()] = node
-		t.cnt += 1
+	if node.NodeId == "" {
+		t.anonymous += 1
+	} else {
+		if old, ok := t.nodes[node.NodeId]; ok {
+			t.remove(old)
+		}
+		t.nodes[node.NodeId] = node
+	}
+	for _, ip := range node.ips() {
+		key, ok := canonicalAddr(ip)
+		if !ok || containsNode(t.hash[key], node) {
+			continue
+		}
+		t.hash[key] = append(t.hash[key], node)
 	}
 }
 
-// Looks up the specified IP to see if it exists and returns the node id if it does.
+// remove drops a node's addresses from the hash
+func (t *TorHash) remove(node *TorNode) {
+	for _, ip := range node.ips() {
+		key, ok := canonicalAddr(ip)
+		if !ok {
+			continue
+		}
+		nodes := make([]*TorNode, 0, len(t.hash[key]))
+		for _, n := range t.hash[key] {
+			if n != node {
+				nodes = append(nodes, n)
+			}
+		}
+		if len(nodes) == 0 {
+			delete(t.hash, key)
+		} else {
+			t.hash[key] = nodes
+		}
+	}
+}
+
+func containsNode(nodes []*TorNode, node *TorNode) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// Looks up the specified IP to see if it's a tor exit and returns the node id if it is.
 func (t *TorHash) Exists(ip net.IP) (string, bool) {
 	if node, ok := t.Lookup(ip); ok {
 		return node.NodeId, true
@@ -79,21 +179,55 @@ func (t *TorHash) Exists(ip net.IP) (string, bool) {
 	return "", false
 }
 
-// Looks up the specified ip to see if it's a tor node. Returns a TorNode or nil and a boolean
+// Looks up the specified ip to see if it's a tor exit. Returns a TorNode or nil and a boolean. If several exits
+// share the address, the first one added is returned. Relays which only use the address as an OR address aren't
+// returned; use LookupAll to get every relay.
 func (t *TorHash) Lookup(ip net.IP) (*TorNode, bool) {
-	if node, ok := t.hash[ip.String()]; ok {
-		return node, true
+	addr, ok := canonicalAddr(ip)
+	if !ok {
+		return nil, false
+	}
+	return t.LookupAddr(addr)
+}
+
+// LookupAddr is Lookup for a netip.Addr
+func (t *TorHash) LookupAddr(addr netip.Addr) (*TorNode, bool) {
+	addr = addr.Unmap()
+	for _, node := range t.hash[addr] {
+		if node.exitsFrom(addr) {
+			return node, true
+		}
 	}
 	return nil, false
 }
 
-// Indicates the number of entries in this hash
+// Returns every node using the specified ip, exit or not, in the order they were added, or nil if there are none
+func (t *TorHash) LookupAll(ip net.IP) []*TorNode {
+	addr, ok := canonicalAddr(ip)
+	if !ok {
+		return nil
+	}
+	return t.hash[addr]
+}
+
+// Looks up a node by its NodeId (fingerprint)
+func (t *TorHash) LookupNode(nodeid string) (*TorNode, bool) {
+	node, ok := t.nodes[nodeid]
+	return node, ok
+}
+
+// Indicates the number of unique addresses in this hash
 func (t *TorHash) Len() int {
-	return t.cnt
+	return len(t.hash)
+}
+
+// Indicates the number of nodes in this hash
+func (t *TorHash) NodeCount() int {
+	return len(t.nodes) + t.anonymous
 }
 
 func (t TorHash) String() string {
-	return fmt.Sprintf("TorHash with %d entries", t.Len())
+	return fmt.Sprintf("TorHash with %d addresses of %d nodes", t.Len(), t.NodeCount())
 }
 
 var _ fmt.Stringer = TorHash{} // Verify that we're a stringer
@@ -0,0 +1,273 @@
+/**
+ * GeoTor
+ *
+ *    Copyright 2018 Tenta, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * For any questions, please contact developer@tenta.io
+ *
+ * tor_test.go: Tor hash tests
+ */
+
+package geotor
+
+import (
+	"github.com/tenta-browser/polychromatic"
+	"io/ioutil"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestTorHashCanonical(t *testing.T) {
+	th := NewTorHash()
+	node := NewTorNode()
+	node.NodeId = "ABCD"
+	node.Addresses = append(node.Addresses,
+		ExitAddress{IP: net.ParseIP("1.2.3.4")}, // 16 byte, IPv4-mapped
+		ExitAddress{IP: net.ParseIP("2001:db8::1")})
+	th.Add(node)
+
+	for _, ip := range []net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("1.2.3.4").To4(), net.ParseIP("::ffff:1.2.3.4"), net.ParseIP("2001:db8::1")} {
+		if id, ok := th.Exists(ip); !ok || id != "ABCD" {
+			t.Errorf("%s not found", ip.String())
+		}
+	}
+	if _, ok := th.LookupAddr(netip.MustParseAddr("::ffff:1.2.3.4")); !ok {
+		t.Error("mapped netip.Addr not found")
+	}
+	if _, ok := th.Lookup(net.IP{1, 2, 3}); ok {
+		t.Error("malformed address found")
+	}
+	ip := net.ParseIP("1.2.3.4")
+	if n := testing.AllocsPerRun(100, func() { th.Exists(ip) }); n != 0 {
+		t.Errorf("lookup allocates %.0f times", n)
+	}
+}
+
+func BenchmarkTorHashLookup(b *testing.B) {
+	th := NewTorHash()
+	for i := 0; i < 2000; i += 1 {
+		node := NewTorNode()
+		node.Addresses = append(node.Addresses, ExitAddress{IP: net.IPv4(10, byte(i>>8), byte(i), 1)})
+		th.Add(node)
+	}
+	hit, miss := net.IPv4(10, 0, 1, 1), net.IPv4(192, 0, 2, 1).To4()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i += 1 {
+		th.Exists(hit)
+		th.Exists(miss)
+	}
+}
+
+func TestTorHashNodes(t *testing.T) {
+	th := NewTorHash()
+	shared := net.ParseIP("1.2.3.4")
+	first, second := NewTorNode(), NewTorNode()
+	first.NodeId, second.NodeId = "AAAA", "BBBB"
+	first.Addresses = append(first.Addresses, ExitAddress{IP: shared}, ExitAddress{IP: shared.To4()})
+	second.Addresses = append(second.Addresses, ExitAddress{IP: shared}, ExitAddress{IP: net.ParseIP("5.6.7.8")})
+	th.Add(first)
+	th.Add(second)
+
+	if th.Len() != 2 || th.NodeCount() != 2 {
+		t.Errorf("expected 2 addresses and 2 nodes, got %d and %d", th.Len(), th.NodeCount())
+	}
+	if nodes := th.LookupAll(shared); len(nodes) != 2 || nodes[0] != first || nodes[1] != second {
+		t.Error("shared address doesn't list both nodes in order")
+	}
+	if id, _ := th.Exists(shared); id != "AAAA" {
+		t.Errorf("later node replaced the earlier one, got %s", id)
+	}
+	if node, ok := th.LookupNode("BBBB"); !ok || node != second {
+		t.Error("lookup by fingerprint failed")
+	}
+
+	// A relay only listening on an exit's address doesn't hide the exit, even if it was added first
+	mixed := NewTorHash()
+	relay := NewTorNode()
+	relay.NodeId = "CCCC"
+	relay.ORAddresses = append(relay.ORAddresses, ORAddress{IP: shared, Port: 9001}, ORAddress{IP: net.ParseIP("7.7.7.7"), Port: 9001})
+	mixed.Add(relay)
+	mixed.Add(first)
+	if id, _ := mixed.Exists(shared); id != "AAAA" {
+		t.Errorf("expected the exit sharing an address with a relay, got %q", id)
+	}
+	if id, ok := mixed.Exists(net.ParseIP("7.7.7.7")); ok {
+		t.Errorf("non-exit relay reported as exit %s", id)
+	}
+	if nodes := mixed.LookupAll(net.ParseIP("7.7.7.7")); len(nodes) != 1 || nodes[0] != relay {
+		t.Error("non-exit relay not listed by LookupAll")
+	}
+
+	// Re-adding a node replaces its old addresses
+	updated := NewTorNode()
+	updated.NodeId = "BBBB"
+	updated.Addresses = append(updated.Addresses, ExitAddress{IP: net.ParseIP("9.9.9.9")})
+	th.Add(updated)
+	if th.Len() != 2 || th.NodeCount() != 2 {
+		t.Errorf("expected 2 addresses and 2 nodes after re-adding, got %d and %d", th.Len(), th.NodeCount())
+	}
+	if _, ok := th.Exists(net.ParseIP("5.6.7.8")); ok {
+		t.Error("stale address of a re-added node still present")
+	}
+	if nodes := th.LookupAll(shared); len(nodes) != 1 {
+		t.Error("re-added node still listed under its old address")
+	}
+}
+
+func TestParseOnionoo(t *testing.T) {
+	body, err := ioutil.ReadFile("testdata/onionoo_details.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := parseonionoo(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 5 {
+		t.Fatalf("expected 5 relays, got %d", len(nodes))
+	}
+	exit := nodes[0]
+	if !exit.IsExit() || exit.Nickname != "ExitRelay" || exit.Country != "de" || exit.Bandwidth != 10485760 || !exit.HasFlag("Stable") {
+		t.Errorf("exit relay parsed incorrectly: %+v", exit)
+	}
+	if len(exit.ORAddresses) != 2 || exit.ORAddresses[1].Port != 9001 || len(exit.Addresses) != 3 {
+		t.Errorf("unexpected exit relay addresses %+v / %+v", exit.ORAddresses, exit.Addresses)
+	}
+	if nodes[1].IsExit() {
+		t.Error("middle relay flagged as an exit")
+	}
+	if !nodes[2].IsExit() {
+		t.Error("bad exit not flagged as an exit, though it still carries traffic")
+	}
+	// Observed exit addresses count regardless of flags, but the OR address of a relay which rejects every port doesn't
+	observed := nodes[3]
+	if len(observed.Addresses) != 1 || !observed.Addresses[0].IP.Equal(net.ParseIP("203.0.113.41")) {
+		t.Errorf("unexpected exit addresses for a relay without the Exit flag %+v", observed.Addresses)
+	}
+
+	th := NewTorHash()
+	for _, node := range nodes {
+		th.Add(node)
+	}
+	if th.NodeCount() != 5 || th.Len() != 8 {
+		t.Errorf("expected 8 addresses of 5 nodes, got %s", th.String())
+	}
+
+	g := &Geo{lg: polychromatic.GetLogger("test")}
+	d := newDataset([kindCount]*dbhandle{}, th)
+	defer d.release()
+	o := newLookupOptions(nil)
+	r, err := g.lookup(net.ParseIP("198.51.100.8"), d, o)
+	if err != nil || r.TorNode == nil || !r.Anonymity.IsTorExitNode {
+		t.Error("exit address not reported as a tor exit")
+	}
+	r, err = g.lookup(net.ParseIP("203.0.113.20"), d, o)
+	if err != nil || r.TorNode != nil || r.Anonymity.IsTorExitNode || len(r.TorRelays) != 1 {
+		t.Error("middle relay not reported as a non-exit relay")
+	}
+	r, err = g.lookup(net.ParseIP("203.0.113.41"), d, o)
+	if err != nil || r.TorNode == nil || !r.Anonymity.IsTorExitNode {
+		t.Error("observed exit address of a relay without the Exit flag not reported as a tor exit")
+	}
+	r, err = g.lookup(net.ParseIP("203.0.113.40"), d, o)
+	if err != nil || r.TorNode != nil || r.Anonymity.IsTorExitNode || len(r.TorRelays) != 1 {
+		t.Error("OR address of a relay which rejects every port reported as a tor exit")
+	}
+
+	// Exists and Lookup only consider exit addresses, even though every relay is indexed
+	if _, ok := th.Exists(net.ParseIP("203.0.113.20")); ok {
+		t.Error("middle relay reported as an exit")
+	}
+	if _, ok := th.Exists(net.ParseIP("203.0.113.40")); ok {
+		t.Error("OR address of an exit which rejects every port reported as an exit")
+	}
+	if id, ok := th.Exists(net.ParseIP("203.0.113.41")); !ok || id != observed.NodeId {
+		t.Error("observed exit address not reported as an exit")
+	}
+}
+
+func TestExitPolicy(t *testing.T) {
+	body, err := ioutil.ReadFile("testdata/onionoo_details.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := parseonionoo(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	th := NewTorHash()
+	for _, node := range nodes {
+		th.Add(node)
+	}
+	if nodes[0].ExitPolicy == nil || len(nodes[0].ExitPolicy.Rules) != 6 {
+		t.Fatal("exit policy not parsed")
+	}
+
+	exit, exitv6 := net.ParseIP("198.51.100.8"), net.ParseIP("2001:db8::7")
+	middle, webonly := net.ParseIP("203.0.113.20"), net.ParseIP("198.51.100.60")
+	cases := []struct {
+		relay net.IP
+		dest  string
+		port  int
+		want  bool
+	}{
+		{exit, "192.0.2.1", 443, true},
+		{exit, "192.0.2.1", 6665, true},
+		{exit, "192.0.2.1", 22, false},
+		{exit, "198.51.100.200", 443, false}, // Rejected by network before the port is accepted
+		{exit, "2001:db8::1", 443, false},    // An IPv6 connection can't come from an IPv4 address
+		{exitv6, "2001:db8::1", 443, true},
+		{exitv6, "2001:db8::1", 80, false},
+		{exitv6, "192.0.2.1", 443, false},
+		{middle, "192.0.2.1", 443, false},
+		{webonly, "192.0.2.1", 443, true}, // No Exit flag, but the policy accepts 443
+		{webonly, "192.0.2.1", 80, false},
+		{net.ParseIP("192.0.2.33"), "192.0.2.1", 443, true},    // BadExit, which still carries traffic
+		{net.ParseIP("203.0.113.40"), "192.0.2.1", 443, false}, // OR address of a relay rejecting every port
+		{net.ParseIP("203.0.113.41"), "192.0.2.1", 443, false}, // Observed exit address, but the policy has since closed
+		{net.ParseIP("192.0.2.99"), "192.0.2.1", 443, false},   // Not a relay
+	}
+	for _, c := range cases {
+		if got := th.CanExitTo(c.relay, net.ParseIP(c.dest), c.port); got != c.want {
+			t.Errorf("%s to %s:%d: got %v, expected %v", c.relay.String(), c.dest, c.port, got, c.want)
+		}
+	}
+
+	// Exits from the exit list have no policy, so they're assumed to exit anywhere
+	listed := NewTorNode()
+	listed.Addresses = append(listed.Addresses, ExitAddress{IP: net.ParseIP("192.0.2.50")})
+	if !listed.CanExitTo(net.ParseIP("192.0.2.1"), 22) {
+		t.Error("exit without a known policy should be able to exit anywhere")
+	}
+	// A known policy decides on its own, whatever the node's flags or exit addresses
+	unflagged := NewTorNode()
+	unflagged.ExitPolicy = &ExitPolicy{SummaryV4: &PolicySummary{Accept: true, Ports: []PortRange{{Low: 443, High: 443}}}}
+	if !unflagged.CanExitTo(net.ParseIP("192.0.2.1"), 443) || unflagged.CanExitTo(net.ParseIP("192.0.2.1"), 80) {
+		t.Error("policy of a node without exit addresses not used")
+	}
+
+	summary := &ExitPolicy{SummaryV4: &PolicySummary{Accept: false, Ports: []PortRange{{Low: 25, High: 25}}}}
+	if summary.Allows(net.ParseIP("192.0.2.1"), 25) || !summary.Allows(net.ParseIP("192.0.2.1"), 443) {
+		t.Error("reject summary evaluated incorrectly")
+	}
+	if _, err := parseExitPolicyRule("accept *:99-1"); err == nil {
+		t.Error("inverted port range accepted")
+	}
+	if rule, err := parseExitPolicyRule("reject [2001:db8::]/32:25"); err != nil || rule.Network.Bits() != 32 || rule.Ports.Low != 25 {
+		t.Errorf("bracketed IPv6 rule parsed incorrectly: %+v %v", rule, err)
+	}
+}
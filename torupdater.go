@@ -24,10 +24,12 @@ package geotor
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"github.com/tenta-browser/polychromatic"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"strings"
@@ -43,9 +45,10 @@ const (
 
 func torupdater(cfg Config, rt *runtime, g *Geo) {
 	defer rt.wg.Done()
-	rt.wg.Add(1)
 
 	lg := polychromatic.GetLogger("torupdater")
+	f := newFetcher(cfg, rt.done)
+	published := false
 
 	ticker := time.NewTicker(cfg.TorUpdateInterval)
 
@@ -54,29 +57,28 @@ func torupdater(cfg Config, rt *runtime, g *Geo) {
 	for {
 		lg.Info("Checking for updates")
 
-		resp, err := http.Get(cfg.TorUrl)
+		body, modified, err := fetchTorList(f, cfg.TorUrl)
 		if err != nil {
 			lg.Errorf("Unable to get tor list: %s", err.Error())
+		} else if !modified && published {
+			lg.Debug("Tor list is unchanged")
+		} else if nodes, err := parsetorlist(cfg.TorFormat, body); err != nil {
+			// Keep serving the previous list rather than one which is empty or partial
+			lg.Warnf("Got an error attempting to tokenize updates, keeping the previous list: %s", err)
 		} else {
 			// Happy days, we got data
 
-			nodes, err := tokenizeresponse(resp.Body)
-			if err != nil {
-				lg.Warnf("Got an error attempting to tokenize updates: %s", err)
-			}
-			resp.Body.Close()
-
 			lg.Debugf("Successfully got %d tor nodes", len(nodes))
 			hash := NewTorHash()
 			for _, node := range nodes {
 				hash.Add(node)
 			}
 
-			lg.Debugf("Successfully built a TorHash with %d entries", hash.Len())
+			lg.Debugf("Successfully built a TorHash with %d addresses of %d nodes", hash.Len(), hash.NodeCount())
 
 			select {
 			case g.newtordb <- hash:
-				break
+				published = true
 			default:
 				lg.Debug("Unable to write new tor hash to geo")
 			}
@@ -93,6 +95,23 @@ func torupdater(cfg Config, rt *runtime, g *Geo) {
 	}
 }
 
+// parsetorlist parses a tor list in the configured format
+func parsetorlist(format TorListFormat, body []byte) ([]*TorNode, error) {
+	if format == TorFormatOnionoo {
+		return parseonionoo(body)
+	}
+	return tokenizeresponse(ioutil.NopCloser(bytes.NewReader(body)))
+}
+
+// fetchTorList downloads the tor list, only transferring it if it has changed since the last time
+func fetchTorList(f *fetcher, url string) ([]byte, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	return f.fetchCached(req)
+}
+
 /**
  * Parse a series of entries like this:
  *
@@ -22,6 +22,8 @@
 
 package geotor
 
+// ISP holds network ownership data. When served from GeoLite2-ASN rather than GeoIP2-ISP, only the autonomous
+// system fields are available, and Organization and ISP are left empty.
 type ISP struct {
 	Organization   string `maxminddb:"organization" json:"organization"`
 	ASNumber       uint   `maxminddb:"autonomous_system_number" json:"as_number"`
@@ -34,15 +36,82 @@ type Position struct {
 	Longitude float32 `maxminddb:"longitude" json:"longitude"`
 	Radius    uint    `maxminddb:"accuracy_radius" json:"uncertainty_km"`
 	TimeZone  string  `maxminddb:"time_zone" json:"time_zone"`
+	MetroCode uint    `maxminddb:"metro_code" json:"metro_code,omitempty"` // US only
+}
+
+type Continent struct {
+	Code      string `json:"code"`
+	Name      string `json:"name"`
+	GeoNameID uint   `json:"geoname_id"`
+}
+
+// Subdivision is a region within a country, such as a state or province
+type Subdivision struct {
+	ISOCode   string `json:"iso_code"`
+	Name      string `json:"name"`
+	GeoNameID uint   `json:"geoname_id"`
+}
+
+type Country struct {
+	ISOCode           string `json:"iso_code"`
+	Name              string `json:"name"`
+	GeoNameID         uint   `json:"geoname_id"`
+	IsInEuropeanUnion bool   `json:"is_in_european_union"`
+	Type              string `json:"type,omitempty"` // Only set for represented countries, e.g. military
+}
+
+// Sections of a GeoLocation, each answered from a single source
+const (
+	SectionLocation       = "location"        // Position, City, Country and the rest of the city record, Location and LocationI18n
+	SectionNetwork        = "network"         // ISP
+	SectionTor            = "tor"             // TorNode, TorRelays, and Anonymity.TorNode
+	SectionAnonymity      = "anonymity"       // Anonymity flags, other than those derived from the tor list
+	SectionConnectionType = "connection_type" // ConnectionType
+	SectionDomain         = "domain"          // Domain
+)
+
+// Anonymity combines the signals that a client may be hiding its real address: the GeoIP2 Anonymous IP flags, and
+// the tor exit list. A tor exit is always flagged as anonymous, even if the database doesn't know about it yet.
+type Anonymity struct {
+	IsAnonymous        bool    `maxminddb:"is_anonymous" json:"is_anonymous"`
+	IsAnonymousVPN     bool    `maxminddb:"is_anonymous_vpn" json:"is_anonymous_vpn"`
+	IsHostingProvider  bool    `maxminddb:"is_hosting_provider" json:"is_hosting_provider"`
+	IsPublicProxy      bool    `maxminddb:"is_public_proxy" json:"is_public_proxy"`
+	IsResidentialProxy bool    `maxminddb:"is_residential_proxy" json:"is_residential_proxy"`
+	IsTorExitNode      bool    `maxminddb:"is_tor_exit_node" json:"is_tor_exit_node"`
+	TorNode            *string `maxminddb:"-" json:"tor_node"`
+}
+
+// SourceResult describes the source consulted for a section of a GeoLocation
+type SourceResult struct {
+	Edition    string `json:"edition"`
+	Found      bool   `json:"found"`                 // Whether the source has a record for the address
+	Version    string `json:"version,omitempty"`     // Version of the database, as reported by its DatabaseSource
+	BuildEpoch uint   `json:"build_epoch,omitempty"` // When the database was built, in seconds since the epoch
+	Network    string `json:"network,omitempty"`     // The network in CIDR notation which the record applies to, if found
 }
 
 type GeoLocation struct {
-	Position     *Position         `json:"position"`
-	ISP          *ISP              `json:"network"`
-	City         string            `json:"city"`
-	Country      string            `json:"country"`
-	CountryISO   string            `json:"iso_country"`
-	Location     string            `json:"location"`
-	LocationI18n map[string]string `json:"localized_location"`
-	TorNode      *string           `json:"tor_node"`
+	Position           *Position                `json:"position"`
+	ISP                *ISP                     `json:"network"`
+	City               string                   `json:"city"`
+	Country            string                   `json:"country"`
+	CountryISO         string                   `json:"iso_country"`
+	CountryGeoNameID   uint                     `json:"country_geoname_id"`
+	CityGeoNameID      uint                     `json:"city_geoname_id"`
+	Continent          *Continent               `json:"continent"`
+	Subdivisions       []Subdivision            `json:"subdivisions"` // Largest to smallest
+	PostalCode         string                   `json:"postal_code"`
+	IsInEuropeanUnion  bool                     `json:"is_in_european_union"`
+	RegisteredCountry  *Country                 `json:"registered_country"`  // Where the ISP registered the network
+	RepresentedCountry *Country                 `json:"represented_country"` // Country represented by users of the network, e.g. a military base
+	Location           string                   `json:"location"`
+	LocationI18n       map[string]string        `json:"localized_location"`
+	Locale             string                   `json:"locale,omitempty"`     // Only when a single locale was negotiated with WithLanguages
+	TorNode            *string                  `json:"tor_node"`             // Tor exit using the address
+	TorRelays          []string                 `json:"tor_relays,omitempty"` // Every tor relay using the address, exit or not
+	Anonymity          *Anonymity               `json:"anonymity"`
+	ConnectionType     string                   `json:"connection_type"` // One of Dialup, Cable/DSL, Corporate, Cellular or Satellite
+	Domain             string                   `json:"domain"`          // Second level domain of the network, e.g. example.com
+	Sources            map[string]*SourceResult `json:"sources"`         // By section, only for the sections which were available
 }